@@ -0,0 +1,133 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"errors"
+
+	"github.com/cloudwego/kitex/pkg/klog"
+	"github.com/hashicorp/consul/api"
+)
+
+// AddressSelection is which consul address the resolver uses for the instances of a service.
+// Whichever is selected, the resolver falls back to the service address, then to the node address,
+// if the instance does not have the selected one.
+type AddressSelection int
+
+const (
+	// SelectServiceAddress uses the address of the service.
+	SelectServiceAddress AddressSelection = iota
+	// SelectNodeAddress uses the address of the node running the service.
+	SelectNodeAddress
+	// SelectLANAddress uses the lan tagged address of the service, or of its node.
+	SelectLANAddress
+	// SelectWANAddress uses the wan tagged address of the service, or of its node.
+	SelectWANAddress
+	// SelectAddressByDatacenter uses the service address for the instances in the datacenter of the local
+	// consul agent, and the wan tagged address for the instances in the other datacenters.
+	SelectAddressByDatacenter
+)
+
+// consul tagged addresses of the LAN and WAN, set on both nodes and services.
+const (
+	taggedLAN = "lan"
+	taggedWAN = "wan"
+)
+
+// instanceAddress returns the host and port of the instance of entry in datacenter dc,
+// according to the address selection and the IP preference of the resolver.
+func (c *consulResolver) instanceAddress(entry *api.ServiceEntry, dc string) (string, int) {
+	svc := entry.Service
+	var host string
+	port := svc.Port
+	switch c.addressSelection(entry, dc) {
+	case SelectNodeAddress:
+		if entry.Node != nil {
+			host = entry.Node.Address
+		}
+	case SelectLANAddress:
+		host, port = taggedAddress(entry, taggedLAN)
+	case SelectWANAddress:
+		host, port = taggedAddress(entry, taggedWAN)
+	}
+	if host == "" {
+		host, port = c.serviceAddress(svc)
+	}
+	if host == "" && entry.Node != nil {
+		host = entry.Node.Address
+	}
+	return host, port
+}
+
+// addressSelection returns the address selection of the instance of entry in datacenter dc.
+func (c *consulResolver) addressSelection(entry *api.ServiceEntry, dc string) AddressSelection {
+	if c.opts.addressSelection != SelectAddressByDatacenter {
+		return c.opts.addressSelection
+	}
+	if entry.Node != nil && entry.Node.Datacenter != "" {
+		dc = entry.Node.Datacenter
+	}
+	if dc == "" {
+		return SelectServiceAddress
+	}
+	local, err := c.localDatacenter()
+	if err != nil {
+		klog.Warnf("get datacenter of consul agent failed, use the service address, err=%v", err)
+		return SelectServiceAddress
+	}
+	if dc == local {
+		return SelectServiceAddress
+	}
+	return SelectWANAddress
+}
+
+// localDatacenter returns the datacenter of the local consul agent, it is queried once and cached.
+// It is shared by the address selection and the nearest datacenter failover.
+func (c *consulResolver) localDatacenter() (string, error) {
+	c.localDCMu.Lock()
+	defer c.localDCMu.Unlock()
+
+	if c.localDC != "" {
+		return c.localDC, nil
+	}
+	self, err := c.consulClient.Agent().Self()
+	if err != nil {
+		return "", err
+	}
+	dc, _ := self["Config"]["Datacenter"].(string)
+	if dc == "" {
+		return "", errors.New("consul agent does not report its datacenter")
+	}
+	c.localDC = dc
+	return dc, nil
+}
+
+// taggedAddress returns the tagged address key of the service of entry, or of its node with the service port.
+// The host is empty if neither has one.
+func taggedAddress(entry *api.ServiceEntry, key string) (string, int) {
+	svc := entry.Service
+	if tagged, ok := svc.TaggedAddresses[key]; ok && tagged.Address != "" {
+		if tagged.Port == 0 {
+			return tagged.Address, svc.Port
+		}
+		return tagged.Address, tagged.Port
+	}
+	if entry.Node != nil && entry.Node.TaggedAddresses[key] != "" {
+		return entry.Node.TaggedAddresses[key], svc.Port
+	}
+	return "", svc.Port
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildResultWithAddressSelection(t *testing.T) {
+	local := fakeServiceEntry("10.0.0.1", 8080)
+	local.Node = &api.Node{
+		Address:         "10.1.0.1",
+		Datacenter:      "dc1",
+		TaggedAddresses: map[string]string{taggedLAN: "10.1.0.1", taggedWAN: "198.51.100.1"},
+	}
+	local.Service.TaggedAddresses = map[string]api.ServiceAddress{
+		taggedWAN: {Address: "203.0.113.1", Port: 9090},
+	}
+	remote := fakeServiceEntry("10.0.0.2", 8080)
+	remote.Node = &api.Node{
+		Address:         "10.1.0.2",
+		Datacenter:      "dc2",
+		TaggedAddresses: map[string]string{taggedLAN: "10.1.0.2", taggedWAN: "198.51.100.2"},
+	}
+	noAddress := fakeServiceEntry("", 8080)
+	noAddress.Node = &api.Node{Address: "10.1.0.3", Datacenter: "dc2"}
+	entries := []*api.ServiceEntry{local, remote, noAddress}
+
+	tests := []struct {
+		name      string
+		selection AddressSelection
+		want      []string
+	}{
+		{
+			name:      "Service",
+			selection: SelectServiceAddress,
+			want:      []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.1.0.3:8080"},
+		},
+		{
+			name:      "Node",
+			selection: SelectNodeAddress,
+			want:      []string{"10.1.0.1:8080", "10.1.0.2:8080", "10.1.0.3:8080"},
+		},
+		{
+			name:      "LAN",
+			selection: SelectLANAddress,
+			want:      []string{"10.1.0.1:8080", "10.1.0.2:8080", "10.1.0.3:8080"},
+		},
+		{
+			name:      "WAN",
+			selection: SelectWANAddress,
+			want:      []string{"203.0.113.1:9090", "198.51.100.2:8080", "10.1.0.3:8080"},
+		},
+		{
+			name:      "By datacenter",
+			selection: SelectAddressByDatacenter,
+			want:      []string{"10.0.0.1:8080", "198.51.100.2:8080", "10.1.0.3:8080"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newConsulResolver(nil, WithAddressSelection(tt.selection))
+			r.localDC = "dc1"
+			result, err := r.buildResult("svc.watch", "", entries)
+			assert.Nil(t, err)
+			var addrs []string
+			for _, ins := range result.Instances {
+				addrs = append(addrs, ins.Address().String())
+			}
+			assert.Equal(t, tt.want, addrs)
+		})
+	}
+}
+
+func TestRegisterWithTaggedAddresses(t *testing.T) {
+	agent := newFakeAgent(t)
+	r := agent.newRegistry(t,
+		WithTaggedAddresses(map[string]api.ServiceAddress{taggedLAN: {Address: "10.0.0.1"}}),
+		WithWANAddress("203.0.113.1", 9090),
+	)
+	info := newTestInfo(8080)
+
+	assert.Nil(t, r.Register(info))
+	req, ok := agent.find("/v1/agent/service/register")
+	if assert.True(t, ok) {
+		assert.Equal(t, map[string]interface{}{
+			taggedLANIPv4: map[string]interface{}{"Address": "10.0.0.1", "Port": float64(8080)},
+			taggedLAN:     map[string]interface{}{"Address": "10.0.0.1", "Port": float64(8080)},
+			taggedWAN:     map[string]interface{}{"Address": "203.0.113.1", "Port": float64(9090)},
+		}, req.Body["TaggedAddresses"])
+	}
+	assert.Nil(t, r.Deregister(info))
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"errors"
+	"net"
+)
+
+// AddressSource is where the registered address of a service comes from.
+type AddressSource int
+
+const (
+	// AddressListened is the address the service listens on.
+	AddressListened AddressSource = iota
+	// AddressAdvertised is the host set by WithAdvertiseAddr.
+	AddressAdvertised
+	// AddressEnv is the host read from the environment variable of WithAdvertiseHostEnv.
+	AddressEnv
+	// AddressAgent is the address advertised by the local consul agent, see WithAgentAddress.
+	AddressAgent
+	// AddressInterface is a local address of the network interfaces.
+	AddressInterface
+)
+
+func (s AddressSource) String() string {
+	switch s {
+	case AddressListened:
+		return "listened address"
+	case AddressAdvertised:
+		return "advertised address"
+	case AddressEnv:
+		return "environment variable"
+	case AddressAgent:
+		return "consul agent"
+	case AddressInterface:
+		return "network interface"
+	default:
+		return "unknown"
+	}
+}
+
+// parseAddr returns the address a service listening on addr is registered with,
+// asking the consul agent for its address if WithAgentAddress is set.
+func (c *consulRegistry) parseAddr(addr net.Addr) (serviceAddr, error) {
+	var agentHost func() (string, error)
+	if c.opts.address.agentAddress {
+		agentHost = c.agentHost
+	}
+	return parseAddr(addr, c.opts.address, agentHost)
+}
+
+// agentHost returns the address advertised by the local consul agent in the LAN gossip pool,
+// it is queried once and cached.
+func (c *consulRegistry) agentHost() (string, error) {
+	c.agentAddrMu.Lock()
+	defer c.agentAddrMu.Unlock()
+
+	if c.agentAddr != "" {
+		return c.agentAddr, nil
+	}
+	self, err := c.consulClient.Agent().Self()
+	if err != nil {
+		return "", err
+	}
+	addr, _ := self["Member"]["Addr"].(string)
+	if net.ParseIP(addr) == nil {
+		return "", errors.New("consul agent does not report a valid address")
+	}
+	c.agentAddr = addr
+	return addr, nil
+}
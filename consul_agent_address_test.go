@@ -0,0 +1,130 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/cloudwego/kitex/pkg/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+// countRequests returns the number of the received requests with the given path.
+func (f *fakeAgent) countRequests(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	for _, req := range f.requests {
+		if req.Path == path {
+			n++
+		}
+	}
+	return n
+}
+
+func TestAgentAddress(t *testing.T) {
+	agent := newFakeAgent(t)
+	agent.respond = func(req fakeAgentRequest) (int, string) {
+		if req.Path == "/v1/agent/self" {
+			return http.StatusOK, `{"Config": {"NodeName": "node-1"}, "Member": {"Addr": "10.0.0.9"}}`
+		}
+		return http.StatusOK, ""
+	}
+	r := agent.newRegistry(t, WithAgentAddress())
+
+	for i := 0; i < 2; i++ {
+		addr, err := r.parseAddr(&net.TCPAddr{IP: net.IPv6unspecified, Port: 8080})
+		assert.Nil(t, err)
+		assert.Equal(t, serviceAddr{host: "10.0.0.9", port: 8080, source: AddressAgent, ipv4: "10.0.0.9"}, addr)
+	}
+	assert.Equal(t, 1, agent.countRequests("/v1/agent/self"))
+
+	// the listened address is kept if specified
+	addr, err := r.parseAddr(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8080})
+	assert.Nil(t, err)
+	assert.Equal(t, AddressListened, addr.source)
+
+	info := newTestInfo(8080)
+	info.Addr = &net.TCPAddr{Port: 8080}
+	assert.Nil(t, r.Register(info))
+	req, _ := agent.find("/v1/agent/service/register")
+	assert.Equal(t, "10.0.0.9", req.Body["Address"])
+	assert.Equal(t, "svc.fake:10.0.0.9:8080", req.Body["ID"])
+	assert.Nil(t, r.Deregister(info))
+}
+
+func TestAgentAddressFallback(t *testing.T) {
+	if _, err := getLocalIPv4Address(); err != nil {
+		t.Skip("no local ipv4 address")
+	}
+	agent := newFakeAgent(t)
+	agent.respond = func(req fakeAgentRequest) (int, string) {
+		return http.StatusInternalServerError, "boom"
+	}
+	r := agent.newRegistry(t, WithAgentAddress())
+
+	addr, err := r.parseAddr(&net.TCPAddr{Port: 8080})
+	assert.Nil(t, err)
+	assert.Equal(t, AddressInterface, addr.source)
+}
+
+func TestDeregisterAfterAgentAddressFallback(t *testing.T) {
+	if _, err := getLocalIPv4Address(); err != nil {
+		t.Skip("no local ipv4 address")
+	}
+	var (
+		mu      sync.Mutex
+		agentUp bool
+		agent   = newFakeAgent(t)
+	)
+	agent.respond = func(req fakeAgentRequest) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if req.Path == "/v1/agent/self" && !agentUp {
+			return http.StatusInternalServerError, "starting"
+		}
+		if req.Path == "/v1/agent/self" {
+			return http.StatusOK, `{"Config": {"NodeName": "node-1"}, "Member": {"Addr": "10.0.0.9"}}`
+		}
+		return http.StatusOK, ""
+	}
+	r := agent.newRegistry(t, WithAgentAddress())
+	info := newTestInfo(8080)
+	info.Addr = &net.TCPAddr{Port: 8080}
+
+	// the service is registered with the interface address while the agent is starting
+	assert.Nil(t, r.Register(info))
+	req, _ := agent.find("/v1/agent/service/register")
+	svcID, _ := req.Body["ID"].(string)
+
+	mu.Lock()
+	agentUp = true
+	mu.Unlock()
+	assert.Nil(t, r.UpdateWeight(info, 50))
+	req, _ = agent.find("/v1/agent/service/register")
+	assert.Equal(t, svcID, req.Body["ID"])
+	assert.Nil(t, r.EnableMaintenance(info, "upgrade"))
+	assert.Nil(t, r.Deregister(&registry.Info{ServiceName: info.ServiceName, Addr: &net.TCPAddr{Port: 8080}}))
+	_, ok := agent.find("/v1/agent/service/deregister/" + svcID)
+	assert.True(t, ok)
+	// the agent is only asked at registration
+	assert.Equal(t, 1, agent.countRequests("/v1/agent/self"))
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cloudwego/kitex/pkg/discovery"
+	"github.com/cloudwego/kitex/pkg/klog"
+)
+
+// lastKnownGoodCache keeps the last successful result of each cache key.
+type lastKnownGoodCache struct {
+	mu      sync.Mutex
+	results map[string]lastKnownGood
+}
+
+type lastKnownGood struct {
+	result    discovery.Result
+	updatedAt time.Time
+}
+
+// apply records the result if it succeeded, or replaces the error with the last known good result
+// if consul could not be reached and the result is not older than maxStaleness.
+func (l *lastKnownGoodCache) apply(key string, result discovery.Result, err error, maxStaleness time.Duration) (discovery.Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err == nil {
+		l.set(key, result, time.Now())
+		return result, nil
+	}
+	if errors.Is(err, ErrNoServiceFound) {
+		delete(l.results, key)
+		return result, err
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return result, err
+	}
+
+	lkg, ok := l.results[key]
+	if !ok {
+		return result, err
+	}
+	staleness := time.Since(lkg.updatedAt)
+	if maxStaleness > 0 && staleness > maxStaleness {
+		klog.Errorf("resolve service %s from consul failed and last known good result is stale for %v, err=%v", key, staleness, err)
+		return result, err
+	}
+	klog.Warnf("resolve service %s from consul failed, serve last known good result stale for %v, err=%v", key, staleness, err)
+	return lkg.result, nil
+}
+
+func (l *lastKnownGoodCache) set(key string, result discovery.Result, updatedAt time.Time) {
+	if l.results == nil {
+		l.results = make(map[string]lastKnownGood)
+	}
+	l.results[key] = lastKnownGood{result: result, updatedAt: updatedAt}
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/kitex/pkg/discovery"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLastKnownGoodCache(t *testing.T) {
+	var (
+		l       lastKnownGoodCache
+		good    = discovery.Result{Cacheable: true, CacheKey: "svc", Instances: []discovery.Instance{discovery.NewInstance("tcp", "10.0.0.1:8080", 10, nil)}}
+		errDown = errors.New("connection refused")
+	)
+
+	// no last known good result yet
+	_, err := l.apply("svc", discovery.Result{}, errDown, time.Minute)
+	assert.Equal(t, errDown, err)
+
+	got, err := l.apply("svc", good, nil, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, good, got)
+
+	// consul down, serve the last known good result
+	got, err = l.apply("svc", discovery.Result{}, errDown, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, good, got)
+
+	// the last known good result is too stale
+	l.set("svc", good, time.Now().Add(-2*time.Minute))
+	_, err = l.apply("svc", discovery.Result{}, errDown, time.Minute)
+	assert.Equal(t, errDown, err)
+	got, err = l.apply("svc", discovery.Result{}, errDown, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, good, got)
+
+	// the service genuinely has no instance
+	_, err = l.apply("svc", discovery.Result{}, ErrNoServiceFound, time.Minute)
+	assert.Equal(t, ErrNoServiceFound, err)
+	_, err = l.apply("svc", discovery.Result{}, errDown, time.Minute)
+	assert.Equal(t, errDown, err)
+}
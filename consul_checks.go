@@ -0,0 +1,175 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudwego/kitex/pkg/klog"
+	"github.com/hashicorp/consul/api"
+)
+
+// placeholders of the check targets, replaced with the registered address of the service by Register.
+const (
+	// CheckAddressPlaceholder is replaced with the registered host and port, e.g. "10.0.0.1:8080" or "[::1]:8080".
+	CheckAddressPlaceholder = "${address}"
+	// CheckHostPlaceholder is replaced with the registered host.
+	CheckHostPlaceholder = "${host}"
+	// CheckPortPlaceholder is replaced with the registered port.
+	CheckPortPlaceholder = "${port}"
+)
+
+// TCPCheck returns a TCP check of the registered address, with the default interval, timeout
+// and DeregisterCriticalServiceAfter.
+func TCPCheck() *api.AgentServiceCheck {
+	check := defaultCheck()
+	check.TCP = CheckAddressPlaceholder
+	return check
+}
+
+// HTTPCheck returns an HTTP check of path on the registered address, e.g. HTTPCheck("/health"),
+// with the default interval, timeout and DeregisterCriticalServiceAfter.
+func HTTPCheck(path string) *api.AgentServiceCheck {
+	check := defaultCheck()
+	check.HTTP = "http://" + CheckAddressPlaceholder + path
+	return check
+}
+
+// GRPCCheck returns a gRPC health check of service on the registered address, or of the whole server if service
+// is empty, with the default interval, timeout and DeregisterCriticalServiceAfter.
+func GRPCCheck(service string) *api.AgentServiceCheck {
+	check := defaultCheck()
+	check.GRPC = CheckAddressPlaceholder
+	if service != "" {
+		check.GRPC += "/" + service
+	}
+	return check
+}
+
+// H2PingCheck returns an HTTP/2 ping check of the registered address over TLS, with the default interval, timeout
+// and DeregisterCriticalServiceAfter. Consul uses TLS by default since H2PingUseTLS is omitted when false,
+// so servers serving plaintext HTTP/2 (h2c) should be checked with TCPCheck or GRPCCheck instead.
+func H2PingCheck() *api.AgentServiceCheck {
+	check := defaultCheck()
+	check.H2PING = CheckAddressPlaceholder
+	check.H2PingUseTLS = true
+	return check
+}
+
+// UDPCheck returns a UDP check of the registered address, with the default interval, timeout
+// and DeregisterCriticalServiceAfter.
+func UDPCheck() *api.AgentServiceCheck {
+	check := defaultCheck()
+	check.UDP = CheckAddressPlaceholder
+	return check
+}
+
+// ttlCheck is a TTL check of a registered service, kept alive by its own heartbeat.
+type ttlCheck struct {
+	id   string
+	name string
+	ttl  time.Duration
+}
+
+// buildChecks returns the checks of the service svcID registered at addr, and the TTL checks among them.
+// Checks without ID get "service:<svcID>" if the service has a single check, or "service:<svcID>:<n>" otherwise,
+// n starting from 1 in the order of the checks.
+// Consul can not probe Unix domain sockets, so the checks filled from the address are skipped for them.
+func (c *consulRegistry) buildChecks(svcID string, addr serviceAddr) (api.AgentServiceChecks, []ttlCheck, error) {
+	checks := make(api.AgentServiceChecks, 0, len(c.opts.checks))
+	var ttlChecks []ttlCheck
+	for i, tmpl := range c.opts.checks {
+		check := copyCheck(tmpl)
+		if check.CheckID == "" {
+			check.CheckID = "service:" + svcID
+			if len(c.opts.checks) > 1 {
+				check.CheckID += ":" + strconv.Itoa(i+1)
+			}
+		}
+		if check.TTL == "" {
+			if isUnixNetwork(addr.network) {
+				if needsCheckAddress(check) {
+					klog.Warnf("skip consul check %s of service %s listening on %s socket %s",
+						check.CheckID, svcID, addr.network, addr.host)
+					continue
+				}
+			} else {
+				fillCheckTarget(check, addr.host, addr.port)
+			}
+		} else {
+			ttl, err := time.ParseDuration(check.TTL)
+			if err != nil {
+				return nil, nil, err
+			}
+			if ttl <= time.Second {
+				return nil, nil, errors.New("consul check ttl must be greater than one second")
+			}
+			ttlChecks = append(ttlChecks, ttlCheck{id: check.CheckID, name: check.Name, ttl: ttl})
+		}
+		checks = append(checks, check)
+	}
+	return checks, ttlChecks, nil
+}
+
+// fillCheckTarget fills the target of check from the address of the service.
+// The placeholders in the targets are replaced, a check without target becomes a TCP check of the address,
+// and the relative targets of HTTP and gRPC checks, e.g. "/health" or "/grpc.health.v1.Health",
+// are completed with the address. The other targets are left as is.
+func fillCheckTarget(check *api.AgentServiceCheck, host string, port int) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	r := strings.NewReplacer(
+		CheckAddressPlaceholder, addr,
+		CheckHostPlaceholder, host,
+		CheckPortPlaceholder, strconv.Itoa(port),
+	)
+	for _, target := range []*string{&check.HTTP, &check.TCP, &check.UDP, &check.GRPC, &check.H2PING} {
+		*target = r.Replace(*target)
+	}
+
+	switch {
+	case strings.HasPrefix(check.HTTP, "/"):
+		check.HTTP = "http://" + addr + check.HTTP
+	case strings.HasPrefix(check.GRPC, "/"):
+		check.GRPC = addr + check.GRPC
+	case !hasCheckTarget(check):
+		check.TCP = addr
+	}
+}
+
+// needsCheckAddress returns whether the target of check is filled from the address of the service.
+func needsCheckAddress(check *api.AgentServiceCheck) bool {
+	if !hasCheckTarget(check) || strings.HasPrefix(check.HTTP, "/") || strings.HasPrefix(check.GRPC, "/") {
+		return true
+	}
+	for _, target := range []string{check.HTTP, check.TCP, check.UDP, check.GRPC, check.H2PING} {
+		if strings.Contains(target, CheckAddressPlaceholder) || strings.Contains(target, CheckHostPlaceholder) ||
+			strings.Contains(target, CheckPortPlaceholder) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCheckTarget returns whether the type of check is set.
+func hasCheckTarget(check *api.AgentServiceCheck) bool {
+	return len(check.Args) > 0 || check.DockerContainerID != "" || check.HTTP != "" || check.TCP != "" ||
+		check.UDP != "" || check.GRPC != "" || check.H2PING != "" || check.AliasNode != "" || check.AliasService != ""
+}
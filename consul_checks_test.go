@@ -0,0 +1,185 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildChecks(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		want    api.AgentServiceChecks
+		wantTTL []ttlCheck
+	}{
+		{
+			name: "Default check",
+			want: api.AgentServiceChecks{{
+				CheckID:                        "service:svc-1",
+				TCP:                            "10.0.0.1:8080",
+				Interval:                       "5s",
+				Timeout:                        "5s",
+				DeregisterCriticalServiceAfter: "1m",
+			}},
+		},
+		{
+			name: "No check",
+			opts: []Option{WithCheck(nil)},
+			want: api.AgentServiceChecks{},
+		},
+		{
+			name: "Nil checks",
+			opts: []Option{WithChecks(nil)},
+			want: api.AgentServiceChecks{},
+		},
+		{
+			name:    "Nil checks ignored",
+			opts:    []Option{WithChecks(nil, &api.AgentServiceCheck{TTL: "10s"}, nil)},
+			want:    api.AgentServiceChecks{{CheckID: "service:svc-1", TTL: "10s"}},
+			wantTTL: []ttlCheck{{id: "service:svc-1", ttl: 10 * time.Second}},
+		},
+		{
+			name: "Multiple checks",
+			opts: []Option{WithChecks(
+				&api.AgentServiceCheck{Interval: "5s"},
+				&api.AgentServiceCheck{HTTP: "/ready", Interval: "5s"},
+				&api.AgentServiceCheck{GRPC: "/grpc.health.v1.Health", Interval: "5s"},
+				&api.AgentServiceCheck{HTTP: "http://10.0.0.2:9090/ready", Interval: "5s"},
+				&api.AgentServiceCheck{CheckID: "app", Name: "app", TTL: "10s"},
+			)},
+			want: api.AgentServiceChecks{
+				{CheckID: "service:svc-1:1", TCP: "10.0.0.1:8080", Interval: "5s"},
+				{CheckID: "service:svc-1:2", HTTP: "http://10.0.0.1:8080/ready", Interval: "5s"},
+				{CheckID: "service:svc-1:3", GRPC: "10.0.0.1:8080/grpc.health.v1.Health", Interval: "5s"},
+				{CheckID: "service:svc-1:4", HTTP: "http://10.0.0.2:9090/ready", Interval: "5s"},
+				{CheckID: "app", Name: "app", TTL: "10s"},
+			},
+			wantTTL: []ttlCheck{{id: "app", name: "app", ttl: 10 * time.Second}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConsulRegistry(nil, tt.opts...)
+			checks, ttlChecks, err := c.buildChecks("svc-1", serviceAddr{host: "10.0.0.1", port: 8080})
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, checks)
+			assert.Equal(t, tt.wantTTL, ttlChecks)
+		})
+	}
+
+	c := newConsulRegistry(nil, WithChecks(&api.AgentServiceCheck{TTL: "1s"}))
+	_, _, err := c.buildChecks("svc-1", serviceAddr{host: "10.0.0.1", port: 8080})
+	assert.NotNil(t, err)
+}
+
+func TestRegisterWithMultipleTTLChecks(t *testing.T) {
+	agent := newFakeAgent(t)
+	r := agent.newRegistry(t,
+		WithChecks(
+			&api.AgentServiceCheck{Name: "liveness", TTL: "2s"},
+			&api.AgentServiceCheck{Name: "readiness", TTL: "2s"},
+		),
+		WithCheckHealthProbe("readiness", func(ctx context.Context) (string, string) {
+			return api.HealthCritical, "warming up"
+		}),
+	)
+	info := newTestInfo(8080)
+
+	assert.Nil(t, r.Register(info))
+	time.Sleep(50 * time.Millisecond)
+
+	req, ok := agent.find("/v1/agent/service/register")
+	if assert.True(t, ok) {
+		assert.Nil(t, req.Body["Check"])
+		checks, _ := req.Body["Checks"].([]interface{})
+		assert.Equal(t, 2, len(checks))
+	}
+	req, ok = agent.find("/v1/agent/check/update/service:svc.fake:10.0.0.1:8080:1")
+	if assert.True(t, ok) {
+		assert.Equal(t, api.HealthPassing, req.Body["Status"])
+	}
+	req, ok = agent.find("/v1/agent/check/update/service:svc.fake:10.0.0.1:8080:2")
+	if assert.True(t, ok) {
+		assert.Equal(t, api.HealthCritical, req.Body["Status"])
+		assert.Equal(t, "warming up", req.Body["Output"])
+	}
+
+	// the check IDs can not be shared by services
+	other := newTestInfo(8081)
+	r2 := agent.newRegistry(t, WithChecks(&api.AgentServiceCheck{CheckID: "shared", TTL: "2s"}))
+	assert.Nil(t, r2.Register(other))
+	other2 := newTestInfo(8082)
+	assert.NotNil(t, r2.Register(other2))
+
+	assert.Nil(t, r.Deregister(info))
+	assert.Nil(t, r2.Deregister(other))
+}
+
+func TestCheckHelpers(t *testing.T) {
+	tests := []struct {
+		name  string
+		check *api.AgentServiceCheck
+		host  string
+		want  *api.AgentServiceCheck
+	}{
+		{name: "TCP", check: TCPCheck(), host: "10.0.0.1", want: &api.AgentServiceCheck{TCP: "10.0.0.1:8080"}},
+		{name: "HTTP", check: HTTPCheck("/health"), host: "10.0.0.1", want: &api.AgentServiceCheck{HTTP: "http://10.0.0.1:8080/health"}},
+		{name: "HTTP on IPv6", check: HTTPCheck("/health"), host: "fd00::1", want: &api.AgentServiceCheck{HTTP: "http://[fd00::1]:8080/health"}},
+		{name: "gRPC", check: GRPCCheck("echo"), host: "10.0.0.1", want: &api.AgentServiceCheck{GRPC: "10.0.0.1:8080/echo"}},
+		{name: "gRPC server", check: GRPCCheck(""), host: "10.0.0.1", want: &api.AgentServiceCheck{GRPC: "10.0.0.1:8080"}},
+		{name: "H2PING", check: H2PingCheck(), host: "10.0.0.1", want: &api.AgentServiceCheck{H2PING: "10.0.0.1:8080", H2PingUseTLS: true}},
+		{name: "UDP", check: UDPCheck(), host: "10.0.0.1", want: &api.AgentServiceCheck{UDP: "10.0.0.1:8080"}},
+		{
+			name:  "Placeholders",
+			check: &api.AgentServiceCheck{HTTP: "https://${host}:${port}/health"},
+			host:  "10.0.0.1",
+			want:  &api.AgentServiceCheck{HTTP: "https://10.0.0.1:8080/health"},
+		},
+		{
+			name:  "User-supplied target",
+			check: &api.AgentServiceCheck{H2PING: "10.0.0.2:9090"},
+			host:  "10.0.0.1",
+			want:  &api.AgentServiceCheck{H2PING: "10.0.0.2:9090"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := copyCheck(tt.check)
+			fillCheckTarget(check, tt.host, 8080)
+			assert.Equal(t, tt.want.TCP, check.TCP)
+			assert.Equal(t, tt.want.HTTP, check.HTTP)
+			assert.Equal(t, tt.want.GRPC, check.GRPC)
+			assert.Equal(t, tt.want.H2PING, check.H2PING)
+			assert.Equal(t, tt.want.H2PingUseTLS, check.H2PingUseTLS)
+			assert.Equal(t, tt.want.UDP, check.UDP)
+		})
+	}
+
+	// the helpers return templates, which are not modified by Register
+	check := HTTPCheck("/health")
+	c := newConsulRegistry(nil, WithChecks(check))
+	checks, _, err := c.buildChecks("svc-1", serviceAddr{host: "10.0.0.1", port: 8080})
+	assert.Nil(t, err)
+	assert.Equal(t, "http://10.0.0.1:8080/health", checks[0].HTTP)
+	assert.Equal(t, "http://${address}/health", check.HTTP)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudwego/kitex/pkg/klog"
+)
+
+// DrainMode is how a service is taken out of rotation before being deregistered.
+type DrainMode int
+
+const (
+	// DrainMaintenance puts the service into consul maintenance mode.
+	DrainMaintenance DrainMode = iota
+	// DrainCritical flips the TTL check of the service to critical,
+	// it falls back to DrainMaintenance if the service has no TTL check.
+	DrainCritical
+)
+
+// DrainStage is the stage of draining a service.
+type DrainStage int
+
+const (
+	// DrainStarted means the service is out of rotation, and the drain period starts.
+	DrainStarted DrainStage = iota
+	// DrainDeregistered means the drain period is over and the service is deregistered.
+	DrainDeregistered
+)
+
+// DrainEvent is the progress of draining a service, notified to the callback of WithDrainCallback.
+type DrainEvent struct {
+	ServiceID string
+	Stage     DrainStage
+	// Deadline is when the drain period is over, only set at DrainStarted.
+	Deadline time.Time
+	// Err is the error of the stage. If the service fails to be taken out of rotation,
+	// the drain period is skipped and the service is deregistered immediately. If it fails to be deregistered,
+	// it stays registered out of rotation with its warmup and weight updates stopped, until Deregister is retried.
+	Err error
+}
+
+// drain takes the service out of rotation, then waits for the drain period.
+// The warmup and weight updates of the service are stopped, and not restarted if deregistering it fails.
+func (c *consulRegistry) drain(svcID string) {
+	c.mu.Lock()
+	svc := c.services[svcID]
+	c.mu.Unlock()
+	if svc != nil {
+		svc.stopWeightUpdates()
+	}
+
+	var err error
+	if c.opts.drainMode == DrainCritical && svc != nil && len(svc.ttlChecks) > 0 {
+		atomic.StoreInt32(&svc.draining, 1)
+		err = c.updateTTLs(svc)
+	} else {
+		err = c.enableDrainMaintenance(svcID, svc)
+	}
+
+	deadline := time.Now().Add(c.opts.drainPeriod)
+	c.notifyDrain(DrainEvent{ServiceID: svcID, Stage: DrainStarted, Deadline: deadline, Err: err})
+	if err != nil {
+		klog.Errorf("drain service %s failed, deregister it immediately, err=%v", svcID, err)
+		return
+	}
+	klog.Infof("draining service %s until %v", svcID, deadline)
+	time.Sleep(time.Until(deadline))
+}
+
+// enableDrainMaintenance puts the service into maintenance mode for draining, keeping the reason of
+// the maintenance mode enabled by EnableMaintenance if any.
+func (c *consulRegistry) enableDrainMaintenance(svcID string, svc *registeredService) error {
+	if svc == nil {
+		return c.consulClient.Agent().EnableServiceMaintenance(svcID, "draining")
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if svc.maintenance {
+		return nil
+	}
+	if err := c.consulClient.Agent().EnableServiceMaintenance(svcID, "draining"); err != nil {
+		return err
+	}
+	svc.maintenance, svc.reason = true, "draining"
+	return nil
+}
+
+func (c *consulRegistry) notifyDrain(event DrainEvent) {
+	if c.opts.drainCallback != nil {
+		c.opts.drainCallback(event)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/serf/coordinate"
+)
+
+// nearestRefreshInterval is how long the datacenters sorted by RTT are cached.
+const nearestRefreshInterval = time.Minute
+
+// nearestDatacenters caches the datacenters sorted by their estimated RTT from the local datacenter.
+type nearestDatacenters struct {
+	mu        sync.Mutex
+	dcs       []string
+	updatedAt time.Time
+}
+
+// failoverDatacenters returns the ordered datacenters to fall back to when the primary one has no instance.
+func (c *consulResolver) failoverDatacenters() ([]string, error) {
+	if len(c.opts.failoverDatacenters) > 0 {
+		return c.opts.failoverDatacenters, nil
+	}
+	if !c.opts.nearestFailover {
+		return nil, nil
+	}
+
+	n := &c.nearest
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.dcs != nil && time.Since(n.updatedAt) < nearestRefreshInterval {
+		return n.dcs, nil
+	}
+	dcs, err := c.sortDatacentersByRTT()
+	if err != nil {
+		if n.dcs != nil {
+			return n.dcs, nil
+		}
+		return nil, err
+	}
+	if limit := c.opts.nearestFailoverLimit; limit > 0 && len(dcs) > limit {
+		dcs = dcs[:limit]
+	}
+	n.dcs, n.updatedAt = dcs, time.Now()
+	return dcs, nil
+}
+
+// sortDatacentersByRTT returns the remote datacenters sorted by the median RTT
+// between the servers of the primary datacenter and theirs, using the coordinate API.
+func (c *consulResolver) sortDatacentersByRTT() ([]string, error) {
+	primary := c.opts.datacenter
+	if primary == "" {
+		local, err := c.localDatacenter()
+		if err != nil {
+			return nil, err
+		}
+		primary = local
+	}
+
+	maps, err := c.consulClient.Coordinate().Datacenters()
+	if err != nil {
+		return nil, err
+	}
+
+	var local *api.CoordinateDatacenterMap
+	for i := range maps {
+		if maps[i].Datacenter == primary {
+			local = maps[i]
+			break
+		}
+	}
+	if local == nil {
+		return nil, fmt.Errorf("no coordinate found for datacenter %s", primary)
+	}
+
+	type dcRTT struct {
+		dc  string
+		rtt time.Duration
+	}
+	var rtts []dcRTT
+	for _, m := range maps {
+		if m.Datacenter == primary {
+			continue
+		}
+		if rtt, ok := medianRTT(local.Coordinates, m.Coordinates); ok {
+			rtts = append(rtts, dcRTT{dc: m.Datacenter, rtt: rtt})
+		}
+	}
+	sort.SliceStable(rtts, func(i, j int) bool { return rtts[i].rtt < rtts[j].rtt })
+
+	dcs := make([]string, 0, len(rtts))
+	for _, r := range rtts {
+		dcs = append(dcs, r.dc)
+	}
+	return dcs, nil
+}
+
+// medianRTT returns the median of the estimated RTT between every pair of coordinates.
+func medianRTT(from, to []api.CoordinateEntry) (time.Duration, bool) {
+	var rtts []time.Duration
+	for _, f := range from {
+		for _, t := range to {
+			if !isCompatibleCoord(f.Coord, t.Coord) {
+				continue
+			}
+			rtts = append(rtts, f.Coord.DistanceTo(t.Coord))
+		}
+	}
+	if len(rtts) == 0 {
+		return 0, false
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	return rtts[len(rtts)/2], true
+}
+
+func isCompatibleCoord(a, b *coordinate.Coordinate) bool {
+	return a != nil && b != nil && a.IsValid() && b.IsValid() && len(a.Vec) == len(b.Vec)
+}
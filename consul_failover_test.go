@@ -0,0 +1,131 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/serf/coordinate"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestResolveFailover tests that the resolver falls back to the failover datacenters and switches back.
+func TestResolveFailover(t *testing.T) {
+	var mu sync.Mutex
+	entriesByDC := map[string][]*consulapi.ServiceEntry{
+		"dc2": {fakeServiceEntry("10.0.2.1", 8080)},
+		"dc3": {fakeServiceEntry("10.0.3.1", 8080)},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := json.Marshal(entriesByDC[r.URL.Query().Get("dc")])
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	r, err := NewConsulResolverWithConfig(&consulapi.Config{Address: strings.TrimPrefix(srv.URL, "http://")},
+		WithFailoverDatacenters("dc2", "dc3"))
+	assert.Nil(t, err)
+
+	result, err := r.Resolve(context.Background(), "svc.watch")
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(result.Instances)) {
+		assert.Equal(t, "10.0.2.1:8080", result.Instances[0].Address().String())
+		dc, _ := result.Instances[0].Tag(DatacenterTagKey)
+		assert.Equal(t, "dc2", dc)
+	}
+	assert.Equal(t, "svc.watch", result.CacheKey)
+
+	mu.Lock()
+	entriesByDC[""] = []*consulapi.ServiceEntry{fakeServiceEntry("10.0.1.1", 8080)}
+	mu.Unlock()
+
+	result, err = r.Resolve(context.Background(), "svc.watch")
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(result.Instances)) {
+		assert.Equal(t, "10.0.1.1:8080", result.Instances[0].Address().String())
+	}
+}
+
+func TestMedianRTT(t *testing.T) {
+	newCoord := func(x float64) *coordinate.Coordinate {
+		c := coordinate.NewCoordinate(coordinate.DefaultConfig())
+		c.Vec[0] = x
+		return c
+	}
+	from := []consulapi.CoordinateEntry{{Coord: newCoord(0)}}
+	to := []consulapi.CoordinateEntry{{Coord: newCoord(0.01)}, {Coord: newCoord(0.02)}, {Coord: newCoord(0.03)}, {Coord: nil}}
+
+	rtt, ok := medianRTT(from, to)
+	assert.True(t, ok)
+	assert.Equal(t, 20*time.Millisecond, rtt.Round(time.Millisecond))
+
+	_, ok = medianRTT(from, nil)
+	assert.False(t, ok)
+}
+
+// TestSortDatacentersByRTT tests that the datacenters are sorted from the cached datacenter of the local agent.
+func TestSortDatacentersByRTT(t *testing.T) {
+	newEntry := func(x float64) consulapi.CoordinateEntry {
+		c := coordinate.NewCoordinate(coordinate.DefaultConfig())
+		c.Vec[0] = x
+		return consulapi.CoordinateEntry{Node: "node", Coord: c}
+	}
+	maps := []*consulapi.CoordinateDatacenterMap{
+		{Datacenter: "dc1", Coordinates: []consulapi.CoordinateEntry{newEntry(0)}},
+		{Datacenter: "dc2", Coordinates: []consulapi.CoordinateEntry{newEntry(0.03)}},
+		{Datacenter: "dc3", Coordinates: []consulapi.CoordinateEntry{newEntry(0.01)}},
+	}
+	var (
+		mu    sync.Mutex
+		selfs int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/agent/self":
+			mu.Lock()
+			selfs++
+			mu.Unlock()
+			w.Write([]byte(`{"Config": {"Datacenter": "dc1"}}`))
+		case "/v1/coordinate/datacenters":
+			body, _ := json.Marshal(maps)
+			w.Write(body)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := consulapi.NewClient(&consulapi.Config{Address: strings.TrimPrefix(srv.URL, "http://")})
+	assert.Nil(t, err)
+	r := newConsulResolver(client)
+	for i := 0; i < 2; i++ {
+		dcs, err := r.sortDatacentersByRTT()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"dc3", "dc2"}, dcs)
+	}
+	mu.Lock()
+	assert.Equal(t, 1, selfs)
+	mu.Unlock()
+}
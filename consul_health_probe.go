@@ -0,0 +1,87 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const defaultHealthProbeTimeout = 500 * time.Millisecond
+
+// HealthProbe reports the health of the service, it is called by the TTL heartbeat at each tick.
+// status must be one of api.HealthPassing, api.HealthWarning and api.HealthCritical,
+// and output is reported as the note of the TTL check.
+// The probe should return once ctx is done, see WithHealthProbeTimeout.
+type HealthProbe func(ctx context.Context) (status, output string)
+
+type probeResult struct {
+	status string
+	output string
+}
+
+// healthProbe returns the health probe of the TTL check.
+func (c *consulRegistry) healthProbe(check ttlCheck) HealthProbe {
+	if probe, ok := c.opts.checkHealthProbes[check.name]; ok {
+		return probe
+	}
+	return c.opts.healthProbe
+}
+
+// probeHealth calls the health probe, and returns the fail-safe status if it panics, hangs,
+// or returns an invalid status. Without health probe, the service is always passing.
+func (c *consulRegistry) probeHealth(probe HealthProbe) (status, output string) {
+	if probe == nil {
+		return api.HealthPassing, "online"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.healthProbeTimeout)
+	defer cancel()
+
+	ch := make(chan probeResult, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				ch <- probeResult{status: c.opts.healthProbeFailStatus, output: fmt.Sprintf("health probe panicked: %v", r)}
+			}
+		}()
+		status, output := probe(ctx)
+		ch <- probeResult{status: status, output: output}
+	}()
+
+	select {
+	case r := <-ch:
+		if isCheckStatus(r.status) {
+			return r.status, r.output
+		}
+		return c.opts.healthProbeFailStatus, fmt.Sprintf("health probe returned invalid status %q: %s", r.status, r.output)
+	case <-ctx.Done():
+		return c.opts.healthProbeFailStatus, fmt.Sprintf("health probe timed out after %v", c.opts.healthProbeTimeout)
+	}
+}
+
+// isCheckStatus returns whether status can be reported to a TTL check.
+func isCheckStatus(status string) bool {
+	switch status {
+	case api.HealthPassing, api.HealthWarning, api.HealthCritical:
+		return true
+	}
+	return false
+}
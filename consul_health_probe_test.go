@@ -0,0 +1,118 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeHealth(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []Option
+		wantStatus string
+		wantOutput string
+	}{
+		{
+			name:       "No probe",
+			wantStatus: api.HealthPassing,
+			wantOutput: "online",
+		},
+		{
+			name: "Warning",
+			opts: []Option{WithHealthProbe(func(ctx context.Context) (string, string) {
+				return api.HealthWarning, "queue is full"
+			})},
+			wantStatus: api.HealthWarning,
+			wantOutput: "queue is full",
+		},
+		{
+			name: "Panic",
+			opts: []Option{WithHealthProbe(func(ctx context.Context) (string, string) {
+				panic("boom")
+			})},
+			wantStatus: api.HealthCritical,
+			wantOutput: "health probe panicked: boom",
+		},
+		{
+			name: "Invalid status",
+			opts: []Option{WithHealthProbe(func(ctx context.Context) (string, string) {
+				return "ok", "fine"
+			})},
+			wantStatus: api.HealthCritical,
+			wantOutput: `health probe returned invalid status "ok": fine`,
+		},
+		{
+			name: "Timeout with custom fail status",
+			opts: []Option{
+				WithHealthProbe(func(ctx context.Context) (string, string) {
+					time.Sleep(time.Second)
+					return api.HealthPassing, "late"
+				}),
+				WithHealthProbeTimeout(50*time.Millisecond, api.HealthWarning),
+			},
+			wantStatus: api.HealthWarning,
+			wantOutput: "health probe timed out after 50ms",
+		},
+		{
+			name: "Invalid fail status ignored",
+			opts: []Option{
+				WithHealthProbe(func(ctx context.Context) (string, string) {
+					panic("boom")
+				}),
+				WithHealthProbeTimeout(50*time.Millisecond, "failing"),
+			},
+			wantStatus: api.HealthCritical,
+			wantOutput: "health probe panicked: boom",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConsulRegistry(nil, tt.opts...)
+			status, output := c.probeHealth(c.opts.healthProbe)
+			assert.Equal(t, tt.wantStatus, status)
+			assert.Equal(t, tt.wantOutput, output)
+		})
+	}
+}
+
+func TestHeartbeatWithHealthProbe(t *testing.T) {
+	agent := newFakeAgent(t)
+	r := agent.newRegistry(t,
+		WithCheck(&api.AgentServiceCheck{TTL: "2s"}),
+		WithHealthProbe(func(ctx context.Context) (string, string) {
+			return api.HealthWarning, "degraded"
+		}),
+	)
+	info := newTestInfo(8080)
+
+	assert.Nil(t, r.Register(info))
+	time.Sleep(50 * time.Millisecond)
+	req, ok := agent.find("/v1/agent/check/update/")
+	if assert.True(t, ok) {
+		assert.True(t, strings.HasSuffix(req.Path, "service:svc.fake:10.0.0.1:8080"))
+		assert.Equal(t, api.HealthWarning, req.Body["Status"])
+		assert.Equal(t, "degraded", req.Body["Output"])
+	}
+	assert.Nil(t, r.Deregister(info))
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudwego/kitex/pkg/klog"
+)
+
+const (
+	defaultHeartbeatFraction   = 0.5
+	defaultHeartbeatJitter     = 0.1
+	defaultHeartbeatMinBackoff = 200 * time.Millisecond
+	// minHeartbeatInterval bounds the heartbeat interval, so that small TTLs and fractions do not flood the agent.
+	minHeartbeatInterval = 100 * time.Millisecond
+)
+
+// HeartbeatStatus is the status of the TTL heartbeat of a check.
+type HeartbeatStatus int
+
+const (
+	// HeartbeatRecovered means the TTL is updated again after failures.
+	HeartbeatRecovered HeartbeatStatus = iota
+	// HeartbeatFailed means the TTL failed to be updated, it is retried with backoff.
+	HeartbeatFailed
+	// HeartbeatReregistered means the service was registered again, since the consul agent lost its TTL check,
+	// e.g. after the agent restarted.
+	HeartbeatReregistered
+)
+
+// HeartbeatEvent is a change of the status of the TTL heartbeat of a check, sent to the channel of WithHeartbeatEvents.
+type HeartbeatEvent struct {
+	ServiceID string
+	CheckID   string
+	Status    HeartbeatStatus
+	// Err is the error of HeartbeatFailed.
+	Err error
+}
+
+// startTTLHeartbeat start a goroutine per TTL check of the service to periodically update its TTL.
+func (c *consulRegistry) startTTLHeartbeat(svc *registeredService) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, check := range svc.ttlChecks {
+		go c.runTTLHeartbeat(ctx, svc, check)
+	}
+	return cancel
+}
+
+// runTTLHeartbeat updates the TTL of the check every fraction of the TTL, and retries with backoff on failure.
+// If the consul agent lost the check, the service is registered again.
+func (c *consulRegistry) runTTLHeartbeat(ctx context.Context, svc *registeredService, check ttlCheck) {
+	interval := time.Duration(float64(check.ttl) * c.opts.heartbeatFraction)
+	if interval < minHeartbeatInterval {
+		interval = minHeartbeatInterval
+	}
+	maxBackoff := interval
+	if c.opts.heartbeatMaxBackoff > 0 && c.opts.heartbeatMaxBackoff < maxBackoff {
+		maxBackoff = c.opts.heartbeatMaxBackoff
+	}
+	backoff := c.opts.heartbeatMinBackoff
+	failing := false
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+
+		generation := atomic.LoadUint64(&svc.generation)
+		err := c.updateTTL(svc, check)
+		if err != nil && isMissingTTLCheck(err) {
+			var reregistered bool
+			if reregistered, err = c.reregisterOnce(ctx, svc, check, generation); reregistered {
+				c.notifyHeartbeat(HeartbeatEvent{ServiceID: svc.id, CheckID: check.id, Status: HeartbeatReregistered})
+			}
+		}
+		if err != nil {
+			klog.Errorf("update ttl to consul failed, retry in %v, err=%v", backoff, err)
+			c.notifyHeartbeat(HeartbeatEvent{ServiceID: svc.id, CheckID: check.id, Status: HeartbeatFailed, Err: err})
+			failing = true
+			timer.Reset(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+
+		if failing {
+			failing = false
+			c.notifyHeartbeat(HeartbeatEvent{ServiceID: svc.id, CheckID: check.id, Status: HeartbeatRecovered})
+		}
+		backoff = c.opts.heartbeatMinBackoff
+		timer.Reset(c.heartbeatInterval(interval))
+	}
+}
+
+// heartbeatInterval returns interval made earlier by a random jitter, but not shorter than minHeartbeatInterval.
+func (c *consulRegistry) heartbeatInterval(interval time.Duration) time.Duration {
+	jitter := int64(float64(interval) * c.opts.heartbeatJitter)
+	if jitter <= 0 {
+		return interval
+	}
+	if d := interval - time.Duration(rand.Int63n(jitter)); d > minHeartbeatInterval {
+		return d
+	}
+	return minHeartbeatInterval
+}
+
+// reregisterOnce registers the service again, unless another heartbeat of the service did since generation,
+// in which case only the TTL of check is updated again. It returns whether the service is registered again.
+func (c *consulRegistry) reregisterOnce(ctx context.Context, svc *registeredService, check ttlCheck,
+	generation uint64,
+) (bool, error) {
+	svc.reregisterMu.Lock()
+	defer svc.reregisterMu.Unlock()
+
+	if atomic.LoadUint64(&svc.generation) != generation {
+		return false, c.updateTTL(svc, check)
+	}
+	klog.Warnf("ttl check %s of service %s is missing in consul agent, register the service again", check.id, svc.id)
+	if err := c.reregister(ctx, svc); err != nil {
+		return false, err
+	}
+	atomic.AddUint64(&svc.generation, 1)
+	return true, nil
+}
+
+// reregister registers the service again with its last registration, after the consul agent lost it,
+// and restores its maintenance mode and the status of its TTL checks.
+func (c *consulRegistry) reregister(ctx context.Context, svc *registeredService) error {
+	if err := c.restoreRegistration(ctx, svc); err != nil || ctx.Err() != nil {
+		return err
+	}
+	// the TTL checks are updated without holding c.mu since the health probes may be slow
+	return c.updateTTLs(svc)
+}
+
+// restoreRegistration registers the service again with its last registration and restores its maintenance mode.
+func (c *consulRegistry) restoreRegistration(ctx context.Context, svc *registeredService) error {
+	unlock := c.lockService(svc.id)
+	defer unlock()
+
+	// the service has been deregistered or registered again meanwhile
+	if ctx.Err() != nil || !c.isRegistered(svc) {
+		return nil
+	}
+
+	if err := c.consulClient.Agent().ServiceRegister(svc.registration); err != nil {
+		return err
+	}
+	return c.restoreMaintenance(svc)
+}
+
+func (c *consulRegistry) notifyHeartbeat(event HeartbeatEvent) {
+	if c.opts.heartbeatEvents == nil {
+		return
+	}
+	select {
+	case c.opts.heartbeatEvents <- event:
+	default:
+	}
+}
+
+// isMissingTTLCheck returns whether err is returned by the consul agent for a TTL check it does not know,
+// which happens when the agent restarted without persisting the service.
+func isMissingTTLCheck(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "does not have associated TTL") || strings.Contains(msg, "Unknown check ID")
+}
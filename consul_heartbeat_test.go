@@ -0,0 +1,157 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// failCheckUpdates makes the first n TTL updates received by the agent fail with body.
+func (f *fakeAgent) failCheckUpdates(n int, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.respond = func(req fakeAgentRequest) (int, string) {
+		if !strings.HasPrefix(req.Path, "/v1/agent/check/update/") || n == 0 {
+			return http.StatusOK, ""
+		}
+		n--
+		return http.StatusInternalServerError, body
+	}
+}
+
+// receiveHeartbeatEvents returns the statuses of the events received on ch within timeout.
+func receiveHeartbeatEvents(ch <-chan HeartbeatEvent, timeout time.Duration) []HeartbeatStatus {
+	var statuses []HeartbeatStatus
+	deadline := time.After(timeout)
+	for {
+		select {
+		case event := <-ch:
+			statuses = append(statuses, event.Status)
+		case <-deadline:
+			return statuses
+		}
+	}
+}
+
+func TestHeartbeatRetry(t *testing.T) {
+	agent := newFakeAgent(t)
+	agent.failCheckUpdates(2, "boom")
+	events := make(chan HeartbeatEvent, 10)
+	r := agent.newRegistry(t,
+		WithCheck(&api.AgentServiceCheck{TTL: "10s"}),
+		WithHeartbeatBackoff(20*time.Millisecond, time.Second),
+		WithHeartbeatEvents(events),
+	)
+	info := newTestInfo(8080)
+
+	assert.Nil(t, r.Register(info))
+	statuses := receiveHeartbeatEvents(events, 200*time.Millisecond)
+	assert.Equal(t, []HeartbeatStatus{HeartbeatFailed, HeartbeatFailed, HeartbeatRecovered}, statuses)
+	assert.Nil(t, r.Deregister(info))
+}
+
+func TestHeartbeatReregister(t *testing.T) {
+	agent := newFakeAgent(t)
+	agent.failCheckUpdates(1, `CheckID "service:svc.fake:10.0.0.1:8080" does not have associated TTL`)
+	events := make(chan HeartbeatEvent, 10)
+	r := agent.newRegistry(t, WithCheck(&api.AgentServiceCheck{TTL: "10s"}), WithHeartbeatEvents(events))
+	info := newTestInfo(8080)
+
+	assert.Nil(t, r.Register(info))
+	statuses := receiveHeartbeatEvents(events, 100*time.Millisecond)
+	assert.Equal(t, []HeartbeatStatus{HeartbeatReregistered}, statuses)
+	assert.Equal(t, []string{"/v1/agent/service/register", "/v1/agent/service/register"}, agent.paths())
+	assert.Nil(t, r.Deregister(info))
+}
+
+func TestHeartbeatReregisterOnce(t *testing.T) {
+	var (
+		agent         = newFakeAgent(t)
+		mu            sync.Mutex
+		registrations int
+	)
+	agent.respond = func(req fakeAgentRequest) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		// the checks are missing until the service is registered again
+		if req.Path == "/v1/agent/service/register" {
+			registrations++
+		} else if strings.HasPrefix(req.Path, "/v1/agent/check/update/") && registrations < 2 {
+			return http.StatusNotFound, `Unknown check ID "` + strings.TrimPrefix(req.Path, "/v1/agent/check/update/") + `"`
+		}
+		return http.StatusOK, ""
+	}
+	events := make(chan HeartbeatEvent, 10)
+	r := agent.newRegistry(t,
+		WithChecks(
+			&api.AgentServiceCheck{Name: "c1", TTL: "10s"},
+			&api.AgentServiceCheck{Name: "c2", TTL: "10s"},
+			&api.AgentServiceCheck{Name: "c3", TTL: "10s"},
+		),
+		WithHeartbeatEvents(events),
+	)
+	info := newTestInfo(8080)
+
+	assert.Nil(t, r.Register(info))
+	statuses := receiveHeartbeatEvents(events, 200*time.Millisecond)
+	assert.Equal(t, []HeartbeatStatus{HeartbeatReregistered}, statuses)
+	assert.Equal(t, 2, agent.countRequests("/v1/agent/service/register"))
+	assert.Nil(t, r.Deregister(info))
+}
+
+func TestHeartbeatInterval(t *testing.T) {
+	c := newConsulRegistry(nil, WithHeartbeat(0.5, 0.2))
+	for i := 0; i < 100; i++ {
+		d := c.heartbeatInterval(10 * time.Second)
+		assert.True(t, d > 8*time.Second && d <= 10*time.Second, d)
+	}
+
+	c = newConsulRegistry(nil, WithHeartbeat(0.5, 0))
+	assert.Equal(t, 10*time.Second, c.heartbeatInterval(10*time.Second))
+
+	c = newConsulRegistry(nil, WithHeartbeat(0.5, 0.5))
+	for i := 0; i < 100; i++ {
+		assert.True(t, c.heartbeatInterval(minHeartbeatInterval) >= minHeartbeatInterval)
+	}
+}
+
+func TestHeartbeatMinInterval(t *testing.T) {
+	agent := newFakeAgent(t)
+	r := agent.newRegistry(t, WithCheck(&api.AgentServiceCheck{TTL: "2s"}), WithHeartbeat(0.001, 0))
+	info := newTestInfo(8080)
+
+	assert.Nil(t, r.Register(info))
+	time.Sleep(350 * time.Millisecond)
+	assert.Nil(t, r.Deregister(info))
+	// the 2ms interval is raised to 100ms
+	assert.True(t, agent.countRequests("/v1/agent/check/update/service:svc.fake:10.0.0.1:8080") <= 5)
+}
+
+func TestIsMissingTTLCheck(t *testing.T) {
+	assert.True(t, isMissingTTLCheck(errors.New(`Unexpected response code: 500 (CheckID "c1" does not have associated TTL)`)))
+	assert.True(t, isMissingTTLCheck(errors.New(`Unexpected response code: 404 (Unknown check ID "c1")`)))
+	assert.False(t, isMissingTTLCheck(errors.New("connection refused")))
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"fmt"
+
+	"github.com/cloudwego/kitex/pkg/registry"
+)
+
+// EnableMaintenance puts the service of info registered by this registry into consul maintenance mode,
+// which takes it out of rotation without deregistering it. reason is shown in consul.
+func (c *consulRegistry) EnableMaintenance(info *registry.Info, reason string) error {
+	svc, err := c.getRegisteredService(info)
+	if err != nil {
+		return err
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if err = c.consulClient.Agent().EnableServiceMaintenance(svc.id, reason); err != nil {
+		return err
+	}
+	svc.maintenance, svc.reason = true, reason
+	return nil
+}
+
+// DisableMaintenance takes the service of info registered by this registry out of consul maintenance mode.
+func (c *consulRegistry) DisableMaintenance(info *registry.Info) error {
+	svc, err := c.getRegisteredService(info)
+	if err != nil {
+		return err
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if err = c.consulClient.Agent().DisableServiceMaintenance(svc.id); err != nil {
+		return err
+	}
+	svc.maintenance, svc.reason = false, ""
+	return nil
+}
+
+// InMaintenance returns whether the service of info registered by this registry is in maintenance mode.
+func (c *consulRegistry) InMaintenance(info *registry.Info) (bool, error) {
+	svc, err := c.getRegisteredService(info)
+	if err != nil {
+		return false, err
+	}
+	inMaintenance, _ := svc.maintenanceState()
+	return inMaintenance, nil
+}
+
+// getRegisteredService returns the state of the service of info registered by this registry.
+func (c *consulRegistry) getRegisteredService(info *registry.Info) (*registeredService, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	svc := c.findService(info)
+	if svc == nil {
+		return nil, fmt.Errorf("service %s at %v is not registered", info.ServiceName, info.Addr)
+	}
+	return svc, nil
+}
+
+// restoreMaintenance enables the maintenance mode of the service again if it is in maintenance,
+// since registering the service again clears its maintenance mode in consul.
+func (c *consulRegistry) restoreMaintenance(svc *registeredService) error {
+	if inMaintenance, reason := svc.maintenanceState(); inMaintenance {
+		return c.consulClient.Agent().EnableServiceMaintenance(svc.id, reason)
+	}
+	return nil
+}
+
+func (s *registeredService) maintenanceState() (bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maintenance, s.reason
+}
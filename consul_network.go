@@ -0,0 +1,79 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+// networkMetaKey is the consul service meta key holding the network of services not listening on TCP.
+const networkMetaKey = "kitex-network"
+
+// NetworkTagKey is the instance tag key holding the network of the instance, e.g. "unix".
+// It is only set for the instances not listening on TCP.
+const NetworkTagKey = "network"
+
+// isUnixNetwork returns whether network is a Unix domain socket network, whose addresses are socket paths.
+func isUnixNetwork(network string) bool {
+	switch network {
+	case "unix", "unixpacket", "unixgram":
+		return true
+	}
+	return false
+}
+
+// socketIDHost returns the host used to generate the service ID of a service listening on the socket path.
+// The consul api puts the service and check IDs unescaped in URL paths, so the characters other than letters,
+// digits, `.`, `_` and `-` are replaced, and the checksum of the path is appended to keep the IDs distinct.
+func socketIDHost(path string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, path)
+	return fmt.Sprintf("%s-%08x", sanitized, crc32.ChecksumIEEE([]byte(path)))
+}
+
+// publishedNetworkMeta adds network to meta if it is not the default network.
+func publishedNetworkMeta(network string, meta map[string]string) map[string]string {
+	if network == "" || network == defaultNetwork {
+		return meta
+	}
+	if meta == nil {
+		meta = make(map[string]string, 1)
+	}
+	meta[networkMetaKey] = network
+	return meta
+}
+
+// acceptsNetwork returns whether the instances of network are resolved, see WithNetworks.
+func (c *consulResolver) acceptsNetwork(network string) bool {
+	if len(c.opts.networks) == 0 {
+		return network == defaultNetwork
+	}
+	for _, n := range c.opts.networks {
+		if n == network {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"net"
+	"testing"
+
+	"github.com/cloudwego/kitex/pkg/registry"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterUnixSocket(t *testing.T) {
+	agent := newFakeAgent(t)
+	r := agent.newRegistry(t, WithChecks(TCPCheck(), &api.AgentServiceCheck{Name: "app", TTL: "10s"}))
+	info := &registry.Info{
+		ServiceName: "svc.fake",
+		Weight:      100,
+		Addr:        &net.UnixAddr{Net: "unix", Name: "/var/run/./kitex//svc?.sock"},
+	}
+
+	assert.Nil(t, r.Register(info))
+	svcID := "svc.fake:" + socketIDHost("/var/run/./kitex//svc?.sock") + ":0"
+	assert.Regexp(t, `^svc\.fake:_var_run_\._kitex__svc_\.sock-[0-9a-f]{8}:0$`, svcID)
+	req, ok := agent.find("/v1/agent/service/register")
+	if assert.True(t, ok) {
+		assert.Equal(t, svcID, req.Body["ID"])
+		assert.Equal(t, "/var/run/./kitex//svc?.sock", req.Body["Address"])
+		assert.Nil(t, req.Body["Port"])
+		meta, _ := req.Body["Meta"].(map[string]interface{})
+		assert.Equal(t, "unix", meta[networkMetaKey])
+		// the TCP check is skipped, only the TTL check is registered
+		check, _ := req.Body["Check"].(map[string]interface{})
+		assert.Equal(t, "10s", check["TTL"])
+		assert.Nil(t, req.Body["Checks"])
+	}
+	assert.Nil(t, r.Deregister(info))
+	_, ok = agent.find("/v1/agent/service/deregister/" + svcID)
+	assert.True(t, ok)
+	assert.NotEqual(t, socketIDHost("/tmp/a/b"), socketIDHost("/tmp/a_b"))
+
+	_, err := parseAddr(&net.UnixAddr{Net: "unix"}, addressOptions{}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestBuildResultWithNetworks(t *testing.T) {
+	unix := fakeServiceEntry("/tmp/svc.sock", 0)
+	unix.Service.Meta = map[string]string{networkMetaKey: "unix"}
+	entries := []*api.ServiceEntry{fakeServiceEntry("10.0.0.1", 8080), unix}
+
+	r := newConsulResolver(nil, WithNetworks("tcp", "unix"))
+	result, err := r.buildResult("svc.watch", "", entries)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(result.Instances)) {
+		assert.Equal(t, "tcp", result.Instances[0].Address().Network())
+		assert.Equal(t, "10.0.0.1:8080", result.Instances[0].Address().String())
+		_, ok := result.Instances[0].Tag(NetworkTagKey)
+		assert.False(t, ok)
+
+		assert.Equal(t, "unix", result.Instances[1].Address().Network())
+		assert.Equal(t, "/tmp/svc.sock", result.Instances[1].Address().String())
+		network, _ := result.Instances[1].Tag(NetworkTagKey)
+		assert.Equal(t, "unix", network)
+	}
+
+	// only the instances listening on TCP are resolved by default
+	r = newConsulResolver(nil)
+	result, err = r.buildResult("svc.watch", "", entries)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(result.Instances)) {
+		assert.Equal(t, "10.0.0.1:8080", result.Instances[0].Address().String())
+	}
+	_, err = r.buildResult("svc.watch", "", []*api.ServiceEntry{unix})
+	assert.Equal(t, ErrNoServiceFound, err)
+}
@@ -21,6 +21,8 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cloudwego/kitex/pkg/klog"
@@ -29,13 +31,70 @@ import (
 )
 
 type options struct {
-	check *api.AgentServiceCheck
+	checks        []*api.AgentServiceCheck
+	warningWeight int
+	tagCodec      TagCodec
+	serviceID     ServiceIDGenerator
+	drainPeriod   time.Duration
+	drainMode     DrainMode
+	drainCallback func(event DrainEvent)
+	warmupPeriod  time.Duration
+	warmupCurve   WarmupCurve
+
+	weightProvider   WeightProvider
+	weightInterval   time.Duration
+	weightHysteresis float64
+
+	healthProbe           HealthProbe
+	checkHealthProbes     map[string]HealthProbe
+	healthProbeTimeout    time.Duration
+	healthProbeFailStatus string
+
+	heartbeatFraction   float64
+	heartbeatJitter     float64
+	heartbeatMinBackoff time.Duration
+	heartbeatMaxBackoff time.Duration
+	heartbeatEvents     chan<- HeartbeatEvent
+
+	address addressOptions
 }
 
 type consulRegistry struct {
-	consulClient    *api.Client
-	opts            options
-	cancelUpdateTTL context.CancelFunc
+	consulClient *api.Client
+	opts         options
+
+	mu       sync.Mutex
+	services map[string]*registeredService
+	// pendingChecks holds the checks of the services being registered, so that their check IDs are reserved
+	pendingChecks map[string]api.AgentServiceChecks
+	// idLocks serializes the consul agent calls made for a service ID, which are made without holding mu
+	idLocks map[string]*idLock
+
+	agentAddrMu sync.Mutex
+	agentAddr   string
+}
+
+// registeredService holds the state of a single service instance, keyed by its service ID.
+type registeredService struct {
+	id                   string
+	info                 *registry.Info
+	registration         *api.AgentServiceRegistration
+	checks               api.AgentServiceChecks
+	ttlChecks            []ttlCheck
+	startTime            time.Time
+	cancelUpdateTTL      context.CancelFunc
+	cancelWarmup         context.CancelFunc
+	cancelWeightProvider context.CancelFunc
+	draining             int32
+	warmingUp            int32
+
+	mu          sync.Mutex
+	maintenance bool
+	reason      string
+
+	// reregisterMu serializes the re-registrations by the TTL heartbeats, generation counts them.
+	reregisterMu sync.Mutex
+	generation   uint64
 }
 
 const kvJoinChar = ":"
@@ -50,7 +109,225 @@ type Option func(o *options)
 // WithCheck is consul registry option to set AgentServiceCheck.
 // If disable consul check, set the check option to nil.
 func WithCheck(check *api.AgentServiceCheck) Option {
-	return func(o *options) { o.check = check }
+	return func(o *options) {
+		o.checks = nil
+		if check != nil {
+			o.checks = []*api.AgentServiceCheck{check}
+		}
+	}
+}
+
+// WithChecks is consul registry option to set multiple checks of the service, e.g. a TCP liveness check,
+// an HTTP readiness check and a TTL application check, it replaces the check of WithCheck.
+// Each TTL check is kept alive by its own heartbeat, and the checks without target are TCP checks of the
+// registered address. HTTP and gRPC checks can be given a target relative to the registered address,
+// e.g. "/health" or "/grpc.health.v1.Health", or be built with TCPCheck, HTTPCheck, GRPCCheck, H2PingCheck and UDPCheck.
+// The nil checks are ignored.
+func WithChecks(checks ...*api.AgentServiceCheck) Option {
+	return func(o *options) {
+		o.checks = make([]*api.AgentServiceCheck, 0, len(checks))
+		for _, check := range checks {
+			if check != nil {
+				o.checks = append(o.checks, check)
+			}
+		}
+	}
+}
+
+// WithWarningWeight is consul registry option to set the weight of the service when its checks are in warning state,
+// so that degraded instances receive reduced traffic. The registered weight is used by default.
+func WithWarningWeight(weight int) Option {
+	return func(o *options) { o.warningWeight = weight }
+}
+
+// WithTagCodec is consul registry option to set the TagCodec encoding the tags of registry.Info,
+// it must match the TagCodec of the resolver. ColonTagCodec is used by default.
+func WithTagCodec(codec TagCodec) Option {
+	return func(o *options) { o.tagCodec = codec }
+}
+
+// WithMetaTags is consul registry option to store the tags of registry.Info in consul service meta
+// instead of consul tags, it is a shortcut of WithTagCodec(MetaTagCodec()).
+// Register fails if the tags exceed the limits of consul meta, see MetaTagCodec.
+func WithMetaTags() Option {
+	return WithTagCodec(MetaTagCodec())
+}
+
+// WithServiceIDGenerator is consul registry option to set how the consul service ID is generated.
+// DefaultServiceIDGenerator is used by default.
+func WithServiceIDGenerator(gen ServiceIDGenerator) Option {
+	return func(o *options) { o.serviceID = gen }
+}
+
+// WithDrain is consul registry option to drain the service before deregistering it.
+// Deregister first takes the service out of rotation according to mode, then waits period
+// while the TTL heartbeat keeps running, so that the client caches stop routing to it, and finally deregisters it.
+func WithDrain(period time.Duration, mode DrainMode) Option {
+	return func(o *options) {
+		o.drainPeriod = period
+		o.drainMode = mode
+	}
+}
+
+// WithDrainCallback is consul registry option to set a callback notified of the progress of draining.
+func WithDrainCallback(callback func(event DrainEvent)) Option {
+	return func(o *options) { o.drainCallback = callback }
+}
+
+// WithWarmup is consul registry option to ramp up the weight of the service after registration, so that
+// cold instances are not flooded. The service is registered with a low weight, then re-registered with increasing
+// weights according to curve, until the registered weight is reached after period. Deregister cancels the warmup.
+func WithWarmup(period time.Duration, curve WarmupCurve) Option {
+	return func(o *options) {
+		o.warmupPeriod = period
+		o.warmupCurve = curve
+	}
+}
+
+// WithWeightProvider is consul registry option to poll provider every interval and update the weight of each
+// registered service accordingly. To avoid flapping, the weight is only updated when it differs from the registered
+// one by more than hysteresis, a fraction of the registered weight, e.g. 0.1 for 10%.
+// The provider is not polled while the service is warming up, see WithWarmup.
+func WithWeightProvider(provider WeightProvider, interval time.Duration, hysteresis float64) Option {
+	return func(o *options) {
+		o.weightProvider = provider
+		o.weightInterval = interval
+		o.weightHysteresis = hysteresis
+	}
+}
+
+// WithHealthProbe is consul registry option to set the probe reporting the health of the service to its TTL check,
+// instead of always reporting passing. It is called at each tick of the TTL heartbeat, so it has no effect without TTL check.
+func WithHealthProbe(probe HealthProbe) Option {
+	return func(o *options) { o.healthProbe = probe }
+}
+
+// WithCheckHealthProbe is consul registry option to set the probe reporting to the TTL checks with the given name,
+// instead of the probe of WithHealthProbe.
+func WithCheckHealthProbe(checkName string, probe HealthProbe) Option {
+	return func(o *options) {
+		if o.checkHealthProbes == nil {
+			o.checkHealthProbes = make(map[string]HealthProbe)
+		}
+		o.checkHealthProbes[checkName] = probe
+	}
+}
+
+// WithHealthProbeTimeout is consul registry option to set how long the heartbeat waits for the health probe,
+// and the status reported when the probe times out, panics or returns an invalid status.
+// By default, the timeout is 500ms and the fail-safe status is api.HealthCritical.
+// failStatus must be one of api.HealthPassing, api.HealthWarning and api.HealthCritical, or it is ignored.
+func WithHealthProbeTimeout(timeout time.Duration, failStatus string) Option {
+	return func(o *options) {
+		if timeout > 0 {
+			o.healthProbeTimeout = timeout
+		}
+		if isCheckStatus(failStatus) {
+			o.healthProbeFailStatus = failStatus
+		}
+	}
+}
+
+// WithHeartbeat is consul registry option to schedule the TTL heartbeat every fraction of the TTL,
+// made earlier by a random jitter of at most jitter of the interval, so that the heartbeats of many instances
+// are spread out. By default, the heartbeat runs every half of the TTL with a jitter of 10%.
+// The heartbeat never runs more often than every 100ms, whatever the TTL and fraction.
+func WithHeartbeat(fraction, jitter float64) Option {
+	return func(o *options) {
+		if fraction > 0 && fraction <= 1 {
+			o.heartbeatFraction = fraction
+		}
+		if jitter >= 0 && jitter < 1 {
+			o.heartbeatJitter = jitter
+		}
+	}
+}
+
+// WithHeartbeatBackoff is consul registry option to set the backoff of the retries when the TTL heartbeat fails.
+// The backoff starts from min and doubles on each consecutive failure, up to max and at most the heartbeat interval.
+// By default, the backoff starts from 200ms.
+func WithHeartbeatBackoff(min, max time.Duration) Option {
+	return func(o *options) {
+		if min > 0 {
+			o.heartbeatMinBackoff = min
+		}
+		o.heartbeatMaxBackoff = max
+	}
+}
+
+// WithHeartbeatEvents is consul registry option to set a channel receiving the changes of the status of the
+// TTL heartbeats, so that the application can react to them. Events are dropped when the channel is full.
+func WithHeartbeatEvents(ch chan<- HeartbeatEvent) Option {
+	return func(o *options) { o.heartbeatEvents = ch }
+}
+
+// WithIPPreference is consul registry option to set which IP family is detected when the service listens
+// on an unspecified address, e.g. ":8888" or "[::]:8888". The detected addresses are registered as the
+// lan_ipv4 and lan_ipv6 tagged addresses of the service. PreferIPv4 is used by default.
+func WithIPPreference(pref IPPreference) Option {
+	return func(o *options) { o.address.ipPreference = pref }
+}
+
+// WithAdvertiseAddr is consul registry option to register the service with the given host and port instead of
+// the listened ones, e.g. behind NAT or in port-mapped containers. An empty host or a zero port keeps the listened one.
+func WithAdvertiseAddr(host string, port int) Option {
+	return func(o *options) {
+		o.address.advertiseHost = host
+		o.address.advertisePort = port
+	}
+}
+
+// WithAdvertiseHostEnv is consul registry option to register the service with the host read from the environment
+// variable name, e.g. "POD_IP", if it is set. It is overridden by the host of WithAdvertiseAddr.
+func WithAdvertiseHostEnv(name string) Option {
+	return func(o *options) { o.address.advertiseHostEnv = name }
+}
+
+// WithInterfaces is consul registry option to only detect the local address of the service among the addresses
+// of the given network interfaces, e.g. "eth0", when the service listens on an unspecified address.
+func WithInterfaces(names ...string) Option {
+	return func(o *options) { o.address.interfaces = names }
+}
+
+// WithAddressCIDRs is consul registry option to only detect the local address of the service among the addresses
+// in one of the allowed CIDRs, if any, and in none of the denied CIDRs, e.g. to skip the docker bridge "172.17.0.0/16",
+// when the service listens on an unspecified address. Register fails if a CIDR is invalid.
+func WithAddressCIDRs(allow, deny []string) Option {
+	return func(o *options) {
+		o.address.allowCIDRs = allow
+		o.address.denyCIDRs = deny
+	}
+}
+
+// WithAgentAddress is consul registry option to register the service with the address advertised by the local
+// consul agent when the service listens on an unspecified address, since it is known to be routable in the cluster.
+// The agent is queried once and its address is cached, and the network interfaces are scanned if it fails.
+// It is overridden by WithAdvertiseAddr and WithAdvertiseHostEnv.
+func WithAgentAddress() Option {
+	return func(o *options) { o.address.agentAddress = true }
+}
+
+// WithTaggedAddresses is consul registry option to set the tagged addresses of the service, e.g. its "wan" address
+// reachable from other datacenters, see WithAddressSelection. The addresses without port get the registered port.
+// They override the lan_ipv4 and lan_ipv6 tagged addresses set from the registered address.
+func WithTaggedAddresses(addrs map[string]api.ServiceAddress) Option {
+	return func(o *options) {
+		o.address.taggedAddresses = make(map[string]api.ServiceAddress, len(addrs))
+		for k, v := range addrs {
+			o.address.taggedAddresses[k] = v
+		}
+	}
+}
+
+// WithWANAddress is consul registry option to set the "wan" tagged address of the service,
+// the registered port is used if port is 0.
+func WithWANAddress(host string, port int) Option {
+	return func(o *options) {
+		if o.address.taggedAddresses == nil {
+			o.address.taggedAddresses = make(map[string]api.ServiceAddress, 1)
+		}
+		o.address.taggedAddresses[taggedWAN] = api.ServiceAddress{Address: host, Port: port}
+	}
 }
 
 // NewConsulRegister create a new registry using consul.
@@ -62,15 +339,7 @@ func NewConsulRegister(address string, opts ...Option) (registry.Registry, error
 		return nil, err
 	}
 
-	op := options{
-		check: defaultCheck(),
-	}
-
-	for _, option := range opts {
-		option(&op)
-	}
-
-	return &consulRegistry{consulClient: client, opts: op}, nil
+	return newConsulRegistry(client, opts...), nil
 }
 
 // NewConsulRegisterWithConfig create a new registry using consul, with a custom config.
@@ -80,132 +349,350 @@ func NewConsulRegisterWithConfig(config *api.Config, opts ...Option) (*consulReg
 		return nil, err
 	}
 
-	op := options{
-		check: defaultCheck(),
-	}
-
-	for _, option := range opts {
-		option(&op)
-	}
-
-	return &consulRegistry{consulClient: client, opts: op}, nil
+	return newConsulRegistry(client, opts...), nil
 }
 
 // NewConsulRegisterWithClient create a new registry using consul, with client.
 func NewConsulRegisterWithClient(client *api.Client, opts ...Option) (*consulRegistry, error) {
+	return newConsulRegistry(client, opts...), nil
+}
+
+func newConsulRegistry(client *api.Client, opts ...Option) *consulRegistry {
 	op := options{
-		check: defaultCheck(),
+		checks:                []*api.AgentServiceCheck{defaultCheck()},
+		tagCodec:              ColonTagCodec(),
+		serviceID:             DefaultServiceIDGenerator(),
+		healthProbeTimeout:    defaultHealthProbeTimeout,
+		healthProbeFailStatus: api.HealthCritical,
+		heartbeatFraction:     defaultHeartbeatFraction,
+		heartbeatJitter:       defaultHeartbeatJitter,
+		heartbeatMinBackoff:   defaultHeartbeatMinBackoff,
 	}
 
 	for _, option := range opts {
 		option(&op)
 	}
 
-	return &consulRegistry{consulClient: client, opts: op}, nil
+	return &consulRegistry{
+		consulClient:  client,
+		opts:          op,
+		services:      make(map[string]*registeredService),
+		pendingChecks: make(map[string]api.AgentServiceChecks),
+		idLocks:       make(map[string]*idLock),
+	}
 }
 
 // Register register a service to consul.
-// Note: the tag map of the service can not contain the `:` character.
+// The start time and warmup duration of info are published in the consul service meta, see WithSlowStart.
+// The time the service is first registered is published if info has no start time.
+// The network of services not listening on TCP, e.g. on Unix domain sockets, is published as well, see WithNetworks.
+// Note: with the default ColonTagCodec, the tag keys of the service can not contain the `:` character.
 func (c *consulRegistry) Register(info *registry.Info) error {
 	if err := validateRegistryInfo(info); err != nil {
 		return err
 	}
 
-	host, port, err := parseAddr(info.Addr)
+	addr, err := c.parseAddr(info.Addr)
 	if err != nil {
 		return err
 	}
+	host, port := addr.host, addr.port
+	klog.Infof("register service %s with host %s and port %d from %v", info.ServiceName, host, port, addr.source)
 
-	svcID, err := getServiceId(info)
+	svcID, err := c.generateServiceID(info, addr)
 	if err != nil {
 		return err
 	}
 
-	tagSlice, err := convTagMapToSlice(info.Tags)
+	tagSlice, meta, err := c.opts.tagCodec.Encode(info.Tags)
 	if err != nil {
 		return err
 	}
+	if err := validateUserMeta(meta); err != nil {
+		return err
+	}
+	startTime := c.startTime(svcID, info)
+	meta = publishedMeta(startTime, info.WarmUp, meta)
+	meta = publishedNetworkMeta(addr.network, meta)
+	if err := validateMeta(meta); err != nil {
+		return err
+	}
 
-	svcInfo := &api.AgentServiceRegistration{
-		ID:      svcID,
-		Address: host,
-		Port:    port,
-		Name:    info.ServiceName,
-		Tags:    tagSlice,
-		Weights: &api.AgentWeights{
-			Passing: info.Weight,
-			Warning: info.Weight,
-		},
-		Check: c.opts.check,
+	checks, ttlChecks, err := c.buildChecks(svcID, addr)
+	if err != nil {
+		return err
 	}
 
-	if c.opts.check != nil && c.opts.check.TTL == "" {
-		c.opts.check.TCP = fmt.Sprintf("%s:%d", host, port)
-		svcInfo.Check = c.opts.check
+	weights := c.newWeights(info.Weight)
+	svcInfo := &api.AgentServiceRegistration{
+		ID:              svcID,
+		Address:         host,
+		Port:            port,
+		Name:            info.ServiceName,
+		Tags:            tagSlice,
+		Meta:            meta,
+		Weights:         weights,
+		TaggedAddresses: addr.taggedAddresses(),
+	}
+	if len(checks) == 1 {
+		svcInfo.Check = checks[0]
+	} else if len(checks) > 1 {
+		svcInfo.Checks = checks
+	}
+	if c.opts.warmupPeriod > 0 {
+		svcInfo.Weights = c.opts.warmupCurve.weights(weights, 0, warmupSteps)
 	}
 
-	var ttl time.Duration
-	if c.opts.check.TTL != "" {
-		ttl, err = time.ParseDuration(c.opts.check.TTL)
-		if err != nil {
-			return err
-		}
-		if ttl <= time.Second {
-			return errors.New("consul check ttl must be greater than one second")
-		}
+	unlock := c.lockService(svcID)
+	defer unlock()
+
+	c.mu.Lock()
+	if err := c.checkIDConflict(svcID, checks); err != nil {
+		c.mu.Unlock()
+		return err
 	}
+	c.pendingChecks[svcID] = checks
+	prev := c.services[svcID]
+	c.mu.Unlock()
 
 	if err := c.consulClient.Agent().ServiceRegister(svcInfo); err != nil {
+		c.mu.Lock()
+		delete(c.pendingChecks, svcID)
+		c.mu.Unlock()
 		return err
 	}
 
-	if c.opts.check.TTL != "" {
-		c.startTTLHeartbeat(ttl)
+	svc := &registeredService{id: svcID, info: info, registration: svcInfo, checks: checks, ttlChecks: ttlChecks,
+		startTime: startTime}
+	// the maintenance mode set by the operator survives registering the service again
+	var maintenanceErr error
+	if prev != nil {
+		prev.stop()
+		svc.maintenance, svc.reason = prev.maintenanceState()
+		maintenanceErr = c.restoreMaintenance(svc)
+	}
+	if len(ttlChecks) > 0 {
+		svc.cancelUpdateTTL = c.startTTLHeartbeat(svc)
+	}
+	if c.opts.warmupPeriod > 0 {
+		svc.cancelWarmup = c.startWarmup(svc, weights)
 	}
+	if c.opts.weightProvider != nil && c.opts.weightInterval > 0 {
+		svc.cancelWeightProvider = c.startWeightProvider(svc)
+	}
+
+	c.mu.Lock()
+	delete(c.pendingChecks, svcID)
+	c.services[svcID] = svc
+	c.mu.Unlock()
 
+	if maintenanceErr != nil {
+		return fmt.Errorf("restore maintenance of service %s failed: %w", svcID, maintenanceErr)
+	}
 	return nil
 }
 
 // Deregister deregister a service from consul.
+// If WithDrain is set, the service is drained before being deregistered, and Deregister blocks until then.
+// If deregistering a drained service fails, it stays out of rotation with its weight frozen, see DrainEvent.
 func (c *consulRegistry) Deregister(info *registry.Info) error {
-	svcID, err := getServiceId(info)
+	svcID, err := c.getServiceID(info)
 	if err != nil {
 		return err
 	}
 
+	if c.opts.drainPeriod > 0 {
+		c.drain(svcID)
+	}
+
+	unlock := c.lockService(svcID)
+	defer unlock()
+
 	err = c.consulClient.Agent().ServiceDeregister(svcID)
+	if c.opts.drainPeriod > 0 {
+		c.notifyDrain(DrainEvent{ServiceID: svcID, Stage: DrainDeregistered, Err: err})
+	}
 	if err != nil {
 		return err
 	}
 
-	if c.cancelUpdateTTL != nil {
-		c.cancelUpdateTTL()
+	c.mu.Lock()
+	svc, ok := c.services[svcID]
+	delete(c.services, svcID)
+	c.mu.Unlock()
+	if ok {
+		svc.stop()
 	}
 
 	return nil
 }
 
-// startTTLHeartbeat start a goroutine to periodically update TTL.
-func (c *consulRegistry) startTTLHeartbeat(ttl time.Duration) {
-	ctx, cancel := context.WithCancel(context.Background())
-	c.cancelUpdateTTL = cancel
-	go func() {
-		if err := c.consulClient.Agent().UpdateTTL(c.opts.check.CheckID, "online", api.HealthPassing); err != nil {
-			klog.Errorf("update ttl to consul failed, err=%v", err)
-		}
-		ticker := time.NewTicker(ttl - 1*time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				if err := c.consulClient.Agent().UpdateTTL(c.opts.check.CheckID, "online", api.HealthPassing); err != nil {
-					klog.Errorf("update ttl to consul failed, err=%v", err)
-				}
-			case <-ctx.Done():
-				return
+// checkIDConflict returns an error if one of checks is already used by another service, registered or being
+// registered. It must be called with c.mu held.
+func (c *consulRegistry) checkIDConflict(svcID string, checks api.AgentServiceChecks) error {
+	for _, check := range checks {
+		for id, svc := range c.services {
+			if id != svcID && svc.hasCheck(check.CheckID) {
+				return fmt.Errorf("consul check id %s is already used by service %s", check.CheckID, id)
+			}
+		}
+		for id, pending := range c.pendingChecks {
+			if id != svcID && hasCheck(pending, check.CheckID) {
+				return fmt.Errorf("consul check id %s is already used by service %s", check.CheckID, id)
 			}
 		}
-	}()
+	}
+	return nil
+}
+
+// idLock is the lock of a service ID, released once no one holds or waits for it.
+type idLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lockService locks the service ID svcID and returns the function unlocking it.
+// The consul agent calls made for a service ID are serialized by its lock, and made without holding c.mu,
+// so that a slow agent call does not block the other services.
+func (c *consulRegistry) lockService(svcID string) (unlock func()) {
+	c.mu.Lock()
+	l, ok := c.idLocks[svcID]
+	if !ok {
+		l = &idLock{}
+		c.idLocks[svcID] = l
+	}
+	l.refs++
+	c.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		c.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(c.idLocks, svcID)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// getServiceID returns the consul service ID of info. The ID of a service registered by this registry is the
+// one it was registered with, since the address may resolve differently, e.g. once the consul agent is reachable.
+func (c *consulRegistry) getServiceID(info *registry.Info) (string, error) {
+	c.mu.Lock()
+	svc := c.findService(info)
+	c.mu.Unlock()
+	if svc != nil {
+		return svc.id, nil
+	}
+
+	addr, err := c.parseAddr(info.Addr)
+	if err != nil {
+		return "", err
+	}
+	return c.generateServiceID(info, addr)
+}
+
+// isRegistered returns whether svc is the service currently registered with its ID.
+func (c *consulRegistry) isRegistered(svc *registeredService) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.services[svc.id] == svc
+}
+
+// findService returns the service registered with info, or with the same name and listened address, c.mu must be held.
+func (c *consulRegistry) findService(info *registry.Info) *registeredService {
+	var found *registeredService
+	for _, svc := range c.services {
+		if svc.info == info {
+			return svc
+		}
+		if found == nil && svc.info.ServiceName == info.ServiceName && info.Addr != nil &&
+			svc.info.Addr.Network() == info.Addr.Network() && svc.info.Addr.String() == info.Addr.String() {
+			found = svc
+		}
+	}
+	return found
+}
+
+// newWeights returns the consul weights of a service registered with the given weight.
+func (c *consulRegistry) newWeights(weight int) *api.AgentWeights {
+	warning := weight
+	if c.opts.warningWeight > 0 {
+		warning = c.opts.warningWeight
+	}
+	return &api.AgentWeights{
+		Passing: weight,
+		Warning: warning,
+	}
+}
+
+// stop stops the background goroutines of the service.
+func (s *registeredService) stop() {
+	if s.cancelUpdateTTL != nil {
+		s.cancelUpdateTTL()
+	}
+	s.stopWeightUpdates()
+}
+
+// stopWarmup stops ramping up the weight of the service.
+func (s *registeredService) stopWarmup() {
+	if s.cancelWarmup != nil {
+		s.cancelWarmup()
+	}
+}
+
+// stopWeightUpdates stops the warmup and the weight provider of the service.
+func (s *registeredService) stopWeightUpdates() {
+	s.stopWarmup()
+	if s.cancelWeightProvider != nil {
+		s.cancelWeightProvider()
+	}
+}
+
+// hasCheck returns whether the service is registered with the check checkID.
+func (s *registeredService) hasCheck(checkID string) bool {
+	return hasCheck(s.checks, checkID)
+}
+
+// hasCheck returns whether checks contains the check checkID.
+func hasCheck(checks api.AgentServiceChecks, checkID string) bool {
+	for _, check := range checks {
+		if check.CheckID == checkID {
+			return true
+		}
+	}
+	return false
+}
+
+// isDraining returns whether the service is being drained by flipping its TTL check to critical.
+func (s *registeredService) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// updateTTL reports the status of the service to its TTL check, as returned by the health probe of the check.
+// In maintenance mode, the TTL check keeps passing, since the maintenance is a separate critical check
+// of consul which keeps the service out of rotation, and a failing TTL check would deregister the service
+// after DeregisterCriticalServiceAfter.
+func (c *consulRegistry) updateTTL(svc *registeredService, check ttlCheck) error {
+	if svc.isDraining() {
+		return c.consulClient.Agent().UpdateTTL(check.id, "draining", api.HealthCritical)
+	}
+	if inMaintenance, reason := svc.maintenanceState(); inMaintenance {
+		return c.consulClient.Agent().UpdateTTL(check.id, "maintenance: "+reason, api.HealthPassing)
+	}
+	status, output := c.probeHealth(c.healthProbe(check))
+	return c.consulClient.Agent().UpdateTTL(check.id, output, status)
+}
+
+// updateTTLs reports the status of the service to all its TTL checks, and returns the first error.
+func (c *consulRegistry) updateTTLs(svc *registeredService) error {
+	var firstErr error
+	for _, check := range svc.ttlChecks {
+		if err := c.updateTTL(svc, check); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 func validateRegistryInfo(info *registry.Info) error {
@@ -227,6 +714,15 @@ func defaultCheck() *api.AgentServiceCheck {
 	return check
 }
 
+// copyCheck returns a shallow copy of check, so that the check passed to WithCheck is never mutated.
+func copyCheck(check *api.AgentServiceCheck) *api.AgentServiceCheck {
+	if check == nil {
+		return nil
+	}
+	cp := *check
+	return &cp
+}
+
 // convTagMapToSlice Tags map be convert to slice.
 // Keys must not contain `:`.
 func convTagMapToSlice(tagMap map[string]string) ([]string, error) {
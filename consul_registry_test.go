@@ -0,0 +1,327 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/kitex/pkg/registry"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAgentRequest is a request received by fakeAgent.
+type fakeAgentRequest struct {
+	Path  string
+	Query string
+	Body  map[string]interface{}
+}
+
+// fakeAgent records the requests to the agent endpoints of consul.
+type fakeAgent struct {
+	mu       sync.Mutex
+	requests []fakeAgentRequest
+	srv      *httptest.Server
+	// respond returns the status code and body of the response to req, 200 is returned if it is nil.
+	respond func(req fakeAgentRequest) (int, string)
+}
+
+func newFakeAgent(t *testing.T) *fakeAgent {
+	f := &fakeAgent{}
+	f.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := fakeAgentRequest{Path: r.URL.Path, Query: r.URL.RawQuery}
+		if data, _ := io.ReadAll(r.Body); len(data) > 0 {
+			json.Unmarshal(data, &req.Body)
+		}
+		f.mu.Lock()
+		f.requests = append(f.requests, req)
+		respond := f.respond
+		f.mu.Unlock()
+		if respond != nil {
+			code, body := respond(req)
+			w.WriteHeader(code)
+			w.Write([]byte(body))
+		}
+	}))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeAgent) newRegistry(t *testing.T, opts ...Option) *consulRegistry {
+	r, err := NewConsulRegisterWithConfig(&api.Config{Address: strings.TrimPrefix(f.srv.URL, "http://")}, opts...)
+	assert.Nil(t, err)
+	return r
+}
+
+// paths returns the paths of the received requests, skipping the TTL updates in passing state.
+func (f *fakeAgent) paths() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var paths []string
+	for _, req := range f.requests {
+		if strings.HasPrefix(req.Path, "/v1/agent/check/update/") && req.Body["Status"] == api.HealthPassing {
+			continue
+		}
+		paths = append(paths, req.Path)
+	}
+	return paths
+}
+
+// find returns the last request whose path has the given prefix.
+func (f *fakeAgent) find(prefix string) (fakeAgentRequest, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := len(f.requests) - 1; i >= 0; i-- {
+		if strings.HasPrefix(f.requests[i].Path, prefix) {
+			return f.requests[i], true
+		}
+	}
+	return fakeAgentRequest{}, false
+}
+
+func newTestInfo(port int) *registry.Info {
+	return &registry.Info{
+		ServiceName: "svc.fake",
+		Weight:      100,
+		Addr:        &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port},
+	}
+}
+
+func TestNewWeights(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want *api.AgentWeights
+	}{
+		{
+			name: "Default warning weight",
+			want: &api.AgentWeights{Passing: 100, Warning: 100},
+		},
+		{
+			name: "Custom warning weight",
+			opts: []Option{WithWarningWeight(10)},
+			want: &api.AgentWeights{Passing: 100, Warning: 10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConsulRegistry(nil, tt.opts...)
+			if got := c.newWeights(100); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newWeights() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeregisterWithDrain(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  DrainMode
+		check *api.AgentServiceCheck
+		want  []string
+	}{
+		{
+			name: "Maintenance",
+			mode: DrainMaintenance,
+			want: []string{
+				"/v1/agent/service/register",
+				"/v1/agent/service/maintenance/svc.fake:10.0.0.1:8080",
+				"/v1/agent/service/deregister/svc.fake:10.0.0.1:8080",
+			},
+		},
+		{
+			name:  "Critical",
+			mode:  DrainCritical,
+			check: &api.AgentServiceCheck{TTL: "5s"},
+			want: []string{
+				"/v1/agent/service/register",
+				"/v1/agent/check/update/service:svc.fake:10.0.0.1:8080",
+				"/v1/agent/service/deregister/svc.fake:10.0.0.1:8080",
+			},
+		},
+		{
+			name: "Critical without TTL check",
+			mode: DrainCritical,
+			want: []string{
+				"/v1/agent/service/register",
+				"/v1/agent/service/maintenance/svc.fake:10.0.0.1:8080",
+				"/v1/agent/service/deregister/svc.fake:10.0.0.1:8080",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				agent  = newFakeAgent(t)
+				mu     sync.Mutex
+				events []DrainEvent
+			)
+			opts := []Option{
+				WithDrain(200*time.Millisecond, tt.mode),
+				WithDrainCallback(func(event DrainEvent) {
+					mu.Lock()
+					defer mu.Unlock()
+					events = append(events, event)
+				}),
+			}
+			if tt.check != nil {
+				opts = append(opts, WithCheck(tt.check))
+			}
+			r := agent.newRegistry(t, opts...)
+			info := newTestInfo(8080)
+
+			assert.Nil(t, r.Register(info))
+			// wait for the first heartbeat
+			time.Sleep(50 * time.Millisecond)
+			start := time.Now()
+			assert.Nil(t, r.Deregister(info))
+			assert.True(t, time.Since(start) >= 200*time.Millisecond)
+
+			assert.Equal(t, tt.want, agent.paths())
+			if assert.Equal(t, 2, len(events)) {
+				assert.Equal(t, DrainStarted, events[0].Stage)
+				assert.Nil(t, events[0].Err)
+				assert.Equal(t, DrainDeregistered, events[1].Stage)
+				assert.Nil(t, events[1].Err)
+			}
+		})
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	agent := newFakeAgent(t)
+	r := agent.newRegistry(t, WithCheck(&api.AgentServiceCheck{TTL: "2s"}))
+	info := newTestInfo(8080)
+
+	err := r.EnableMaintenance(info, "upgrade")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, r.Register(info))
+	assert.Nil(t, r.EnableMaintenance(info, "upgrade"))
+	req, ok := agent.find("/v1/agent/service/maintenance/")
+	if assert.True(t, ok) {
+		assert.Equal(t, "/v1/agent/service/maintenance/svc.fake:10.0.0.1:8080", req.Path)
+		assert.Contains(t, req.Query, "enable=true")
+		assert.Contains(t, req.Query, "reason=upgrade")
+	}
+	inMaintenance, err := r.InMaintenance(info)
+	assert.Nil(t, err)
+	assert.True(t, inMaintenance)
+
+	// the heartbeat keeps the TTL check passing, with the reason as note
+	time.Sleep(1200 * time.Millisecond)
+	req, ok = agent.find("/v1/agent/check/update/")
+	if assert.True(t, ok) {
+		assert.Equal(t, api.HealthPassing, req.Body["Status"])
+		assert.Equal(t, "maintenance: upgrade", req.Body["Output"])
+	}
+
+	assert.Nil(t, r.DisableMaintenance(info))
+	req, _ = agent.find("/v1/agent/service/maintenance/")
+	assert.Contains(t, req.Query, "enable=false")
+	inMaintenance, _ = r.InMaintenance(info)
+	assert.False(t, inMaintenance)
+	assert.Nil(t, r.Deregister(info))
+}
+
+func TestRegisterAgainKeepsMaintenance(t *testing.T) {
+	agent := newFakeAgent(t)
+	r := agent.newRegistry(t)
+	info := newTestInfo(8080)
+
+	assert.Nil(t, r.Register(info))
+	assert.Nil(t, r.EnableMaintenance(info, "upgrade"))
+	assert.Nil(t, r.Register(info))
+
+	assert.Equal(t, 2, agent.countRequests("/v1/agent/service/maintenance/svc.fake:10.0.0.1:8080"))
+	req, _ := agent.find("/v1/agent/service/maintenance/")
+	assert.Contains(t, req.Query, "reason=upgrade")
+	inMaintenance, err := r.InMaintenance(info)
+	assert.Nil(t, err)
+	assert.True(t, inMaintenance)
+	assert.Nil(t, r.Deregister(info))
+}
+
+func TestSlowAgentCallDoesNotBlockOtherServices(t *testing.T) {
+	agent := newFakeAgent(t)
+	agent.respond = func(req fakeAgentRequest) (int, string) {
+		if req.Path == "/v1/agent/service/register" && req.Body["ID"] == "svc.fake:10.0.0.1:8080" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		return http.StatusOK, ""
+	}
+	r := agent.newRegistry(t)
+	slow := newTestInfo(8080)
+	done := make(chan error, 1)
+	go func() { done <- r.Register(slow) }()
+	time.Sleep(100 * time.Millisecond)
+
+	// the registry is not held while the consul agent registers the first service
+	start := time.Now()
+	info := newTestInfo(8081)
+	assert.Nil(t, r.Register(info))
+	assert.Nil(t, r.UpdateWeight(info, 50))
+	assert.Nil(t, r.Deregister(info))
+	assert.True(t, time.Since(start) < 300*time.Millisecond)
+	assert.Nil(t, <-done)
+	assert.Nil(t, r.Deregister(slow))
+}
+
+func TestCheckIDReservedWhileRegistering(t *testing.T) {
+	agent := newFakeAgent(t)
+	agent.respond = func(req fakeAgentRequest) (int, string) {
+		if req.Path == "/v1/agent/service/register" && req.Body["ID"] == "svc.fake:10.0.0.1:8080" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return http.StatusOK, ""
+	}
+	r := agent.newRegistry(t, WithCheck(&api.AgentServiceCheck{CheckID: "shared", TTL: "5s"}))
+	info := newTestInfo(8080)
+	done := make(chan error, 1)
+	go func() { done <- r.Register(info) }()
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Error(t, r.Register(newTestInfo(8081)))
+	assert.Nil(t, <-done)
+	assert.Nil(t, r.Deregister(info))
+}
+
+func TestDrainKeepsMaintenanceReason(t *testing.T) {
+	agent := newFakeAgent(t)
+	r := agent.newRegistry(t, WithDrain(50*time.Millisecond, DrainMaintenance))
+	info := newTestInfo(8080)
+
+	assert.Nil(t, r.Register(info))
+	assert.Nil(t, r.EnableMaintenance(info, "upgrade"))
+	assert.Nil(t, r.Deregister(info))
+
+	// the service is already out of rotation, its maintenance reason is kept
+	assert.Equal(t, 1, agent.countRequests("/v1/agent/service/maintenance/svc.fake:10.0.0.1:8080"))
+	req, _ := agent.find("/v1/agent/service/maintenance/")
+	assert.Contains(t, req.Query, "reason=upgrade")
+}
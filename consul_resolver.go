@@ -19,26 +19,306 @@ package consul
 import (
 	"context"
 	"errors"
-	"fmt"
+	"io"
+	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cloudwego/kitex/pkg/discovery"
+	"github.com/cloudwego/kitex/pkg/klog"
 	"github.com/cloudwego/kitex/pkg/rpcinfo"
 	"github.com/hashicorp/consul/api"
 )
 
 const (
 	defaultNetwork = "tcp"
+
+	defaultWatchWaitTime   = 30 * time.Second
+	defaultWatchMinBackoff = time.Second
+	defaultWatchMaxBackoff = 30 * time.Second
 )
 
+// DatacenterTagKey is the instance tag key holding the consul datacenter of the instance,
+// unless the instance already has a tag with this key.
+const DatacenterTagKey = "dc"
+
+// ErrNoServiceFound is returned by Resolve when consul reports no instance of the service,
+// as opposed to the errors returned when consul can not be reached.
+var ErrNoServiceFound = errors.New("no service found")
+
+// ErrResolverClosed is returned by Resolve once the resolver is closed, if it watches services, see WithWatch.
+var ErrResolverClosed = errors.New("consul resolver closed")
+
+type resolverOptions struct {
+	watch           bool
+	watchWaitTime   time.Duration
+	watchMinBackoff time.Duration
+	watchMaxBackoff time.Duration
+	watchNotify     func(change discovery.Change)
+
+	tags              []string
+	filter            string
+	datacenter        string
+	allowStale        bool
+	requireConsistent bool
+	useCache          bool
+	maxAge            time.Duration
+	nodeMeta          map[string]string
+	near              string
+
+	failoverDatacenters  []string
+	nearestFailover      bool
+	nearestFailoverLimit int
+
+	preparedQuery bool
+
+	warningInstances bool
+
+	lastKnownGood bool
+	maxStaleness  time.Duration
+
+	snapshotDir    string
+	snapshotMaxAge time.Duration
+
+	tagCodec       TagCodec
+	metaTags       bool
+	metaPrecedence MetaPrecedence
+
+	slowStart           bool
+	slowStartWindow     time.Duration
+	slowStartAggression float64
+
+	ipPreference IPPreference
+
+	networks []string
+
+	addressSelection AddressSelection
+}
+
 type consulResolver struct {
 	consulClient *api.Client
+	opts         resolverOptions
+
+	// ctx is canceled once the resolver is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	watchers map[string]*serviceWatcher
+	nearest  nearestDatacenters
+	lkg      lastKnownGoodCache
+	snapshot *snapshotStore
+
+	localDCMu sync.Mutex
+	localDC   string
+}
+
+var (
+	_ discovery.Resolver = (*consulResolver)(nil)
+	_ io.Closer          = (*consulResolver)(nil)
+)
+
+// ResolverOption is consul resolver option.
+type ResolverOption func(o *resolverOptions)
+
+// WithWatch is consul resolver option to resolve services with blocking queries.
+// Each service is watched by a long-lived query which waits at most waitTime for a change,
+// and Resolve is served from the local snapshot kept up to date by the watcher.
+// The watchers run until the resolver is closed, see the io.Closer implemented by the resolver,
+// or until their service has not been resolved for 10 minutes.
+// If waitTime is not positive, a default wait time of 30s is used.
+func WithWatch(waitTime time.Duration) ResolverOption {
+	return func(o *resolverOptions) {
+		o.watch = true
+		if waitTime > 0 {
+			o.watchWaitTime = waitTime
+		}
+	}
+}
+
+// WithWatchBackoff is consul resolver option to set the retry backoff of the watcher when a query fails.
+// The backoff starts from min and doubles on each consecutive failure, up to max.
+func WithWatchBackoff(min, max time.Duration) ResolverOption {
+	return func(o *resolverOptions) {
+		if min > 0 {
+			o.watchMinBackoff = min
+		}
+		if max >= o.watchMinBackoff {
+			o.watchMaxBackoff = max
+		}
+	}
+}
+
+// WithWatchNotify is consul resolver option to set a callback which is called by the watcher
+// as soon as the instances of a watched service change.
+func WithWatchNotify(notify func(change discovery.Change)) ResolverOption {
+	return func(o *resolverOptions) { o.watchNotify = notify }
+}
+
+// WithServiceTags is consul resolver option to only resolve the instances with all the given consul tags.
+func WithServiceTags(tags ...string) ResolverOption {
+	return func(o *resolverOptions) { o.tags = tags }
+}
+
+// WithFilter is consul resolver option to set a consul filter expression on the health entries,
+// e.g. `Service.Meta.env == "prod"`.
+func WithFilter(filter string) ResolverOption {
+	return func(o *resolverOptions) { o.filter = filter }
+}
+
+// WithDatacenter is consul resolver option to resolve services in the given datacenter.
+// The datacenter of the consul agent is used by default.
+func WithDatacenter(dc string) ResolverOption {
+	return func(o *resolverOptions) { o.datacenter = dc }
+}
+
+// WithAllowStale is consul resolver option to allow any consul server to serve the query,
+// it overrides WithRequireConsistent.
+func WithAllowStale() ResolverOption {
+	return func(o *resolverOptions) {
+		o.allowStale = true
+		o.requireConsistent = false
+	}
 }
 
-var _ discovery.Resolver = (*consulResolver)(nil)
+// WithRequireConsistent is consul resolver option to force the query to be served consistently by the leader,
+// it overrides WithAllowStale.
+func WithRequireConsistent() ResolverOption {
+	return func(o *resolverOptions) {
+		o.requireConsistent = true
+		o.allowStale = false
+	}
+}
+
+// WithCache is consul resolver option to serve the query from the agent cache.
+// If maxAge is positive, cached results older than maxAge are refreshed before being served.
+func WithCache(maxAge time.Duration) ResolverOption {
+	return func(o *resolverOptions) {
+		o.useCache = true
+		o.maxAge = maxAge
+	}
+}
+
+// WithNodeMeta is consul resolver option to only resolve the instances on nodes with the given node metadata.
+func WithNodeMeta(nodeMeta map[string]string) ResolverOption {
+	return func(o *resolverOptions) { o.nodeMeta = nodeMeta }
+}
+
+// WithNear is consul resolver option to sort the instances by their estimated RTT to the given node,
+// "_agent" can be used for the node of the local agent.
+func WithNear(near string) ResolverOption {
+	return func(o *resolverOptions) { o.near = near }
+}
+
+// WithFailoverDatacenters is consul resolver option to set the ordered datacenters to fall back to
+// when the service has no passing instance in the primary datacenter.
+// The primary datacenter is always tried first, so the resolver switches back as soon as it recovers.
+func WithFailoverDatacenters(dcs ...string) ResolverOption {
+	return func(o *resolverOptions) { o.failoverDatacenters = dcs }
+}
+
+// WithNearestFailover is consul resolver option to fall back to the other datacenters ordered by their
+// estimated RTT, computed from the consul coordinate API. If limit is positive, only the nearest limit
+// datacenters are tried. It is ignored if WithFailoverDatacenters is set.
+func WithNearestFailover(limit int) ResolverOption {
+	return func(o *resolverOptions) {
+		o.nearestFailover = true
+		o.nearestFailoverLimit = limit
+	}
+}
+
+// WithPreparedQuery is consul resolver option to resolve the target through the consul prepared query
+// whose name or ID is the target service name, so that the failover, templates and Near of the query are used.
+// Since prepared queries are not blocking, WithWatch and the failover options are ignored in this mode,
+// as well as WithServiceTags and WithFilter which are defined by the prepared query itself.
+func WithPreparedQuery() ResolverOption {
+	return func(o *resolverOptions) { o.preparedQuery = true }
+}
+
+// WithWarningInstances is consul resolver option to also resolve the instances whose checks are in warning state,
+// with their warning weight instead of the passing one, so that degraded instances receive reduced traffic.
+func WithWarningInstances() ResolverOption {
+	return func(o *resolverOptions) { o.warningInstances = true }
+}
+
+// WithLastKnownGood is consul resolver option to serve the last successful result of a service
+// when consul can not be reached, for at most maxStaleness. If maxStaleness is not positive, the
+// last successful result is served until consul recovers. ErrNoServiceFound is never masked.
+func WithLastKnownGood(maxStaleness time.Duration) ResolverOption {
+	return func(o *resolverOptions) {
+		o.lastKnownGood = true
+		o.maxStaleness = maxStaleness
+	}
+}
+
+// WithSnapshotDir is consul resolver option to persist the resolved instances of each service into dir,
+// and to resolve them from there when consul can not be reached, e.g. when the client starts during an outage.
+// The directory can be shared by multiple processes.
+func WithSnapshotDir(dir string) ResolverOption {
+	return func(o *resolverOptions) { o.snapshotDir = dir }
+}
+
+// WithSnapshotMaxAge is consul resolver option to not serve the snapshots of WithSnapshotDir updated more than
+// maxAge ago, since their instances may have been removed meanwhile. If maxAge is not positive, which is the
+// default, the snapshots are served whatever their age. The age of a served snapshot is always logged.
+func WithSnapshotMaxAge(maxAge time.Duration) ResolverOption {
+	return func(o *resolverOptions) { o.snapshotMaxAge = maxAge }
+}
+
+// WithResolverTagCodec is consul resolver option to set the TagCodec decoding the tags of instances,
+// it must match the TagCodec of the registry. ColonTagCodec is used by default.
+func WithResolverTagCodec(codec TagCodec) ResolverOption {
+	return func(o *resolverOptions) { o.tagCodec = codec }
+}
+
+// WithResolverMetaTags is consul resolver option to merge consul service meta into the tags of instances,
+// in addition to the tags decoded by the TagCodec. precedence decides the value of keys present in both.
+func WithResolverMetaTags(precedence MetaPrecedence) ResolverOption {
+	return func(o *resolverOptions) {
+		o.metaTags = true
+		o.metaPrecedence = precedence
+	}
+}
+
+// WithSlowStart is consul resolver option to scale down the weight of the instances started less than window ago,
+// according to the start time published by the registry, so that freshly started instances receive reduced traffic
+// even if their registry does not ramp up their weight. The weight is scaled by (age / window) ^ (1 / aggression),
+// so an aggression of 1 ramps up linearly and greater values ramp up faster at the beginning.
+// If aggression is not positive, 1 is used. The warmup duration of registry.Info, if published, overrides window.
+func WithSlowStart(window time.Duration, aggression float64) ResolverOption {
+	return func(o *resolverOptions) {
+		o.slowStart = true
+		o.slowStartWindow = window
+		o.slowStartAggression = aggression
+	}
+}
+
+// WithResolverIPPreference is consul resolver option to resolve the lan_ipv4 or lan_ipv6 tagged address of instances
+// with PreferIPv4 or PreferIPv6, falling back to their primary address if they do not have one.
+// DualStack is used by default, which resolves the primary address of instances.
+func WithResolverIPPreference(pref IPPreference) ResolverOption {
+	return func(o *resolverOptions) { o.ipPreference = pref }
+}
+
+// WithNetworks is consul resolver option to resolve the instances listening on one of networks,
+// e.g. WithNetworks("tcp", "unix") for the clients on the same host as the instances listening on Unix domain sockets.
+// Only the instances listening on TCP are resolved by default, since the socket paths of the instances on other
+// hosts can not be dialed.
+func WithNetworks(networks ...string) ResolverOption {
+	return func(o *resolverOptions) { o.networks = networks }
+}
+
+// WithAddressSelection is consul resolver option to select which consul address is resolved for the instances,
+// e.g. SelectAddressByDatacenter so that the instances in other datacenters are reached through their wan address.
+// SelectServiceAddress is used by default. The node address is used for the instances without service address.
+func WithAddressSelection(selection AddressSelection) ResolverOption {
+	return func(o *resolverOptions) { o.addressSelection = selection }
+}
 
 // NewConsulResolver create a service resolver using consul.
-func NewConsulResolver(address string) (discovery.Resolver, error) {
+func NewConsulResolver(address string, opts ...ResolverOption) (discovery.Resolver, error) {
 	config := api.DefaultConfig()
 	config.Address = address
 	client, err := api.NewClient(config)
@@ -46,17 +326,45 @@ func NewConsulResolver(address string) (discovery.Resolver, error) {
 		return nil, err
 	}
 
-	return &consulResolver{consulClient: client}, nil
+	return newConsulResolver(client, opts...), nil
 }
 
 // NewConsulResolverWithConfig create a service resolver using consul, with a custom config.
-func NewConsulResolverWithConfig(config *api.Config) (discovery.Resolver, error) {
+func NewConsulResolverWithConfig(config *api.Config, opts ...ResolverOption) (discovery.Resolver, error) {
 	client, err := api.NewClient(config)
 	if err != nil {
 		return nil, err
 	}
 
-	return &consulResolver{consulClient: client}, nil
+	return newConsulResolver(client, opts...), nil
+}
+
+func newConsulResolver(client *api.Client, opts ...ResolverOption) *consulResolver {
+	op := resolverOptions{
+		watchWaitTime:   defaultWatchWaitTime,
+		watchMinBackoff: defaultWatchMinBackoff,
+		watchMaxBackoff: defaultWatchMaxBackoff,
+		tagCodec:        ColonTagCodec(),
+		ipPreference:    DualStack,
+	}
+
+	for _, option := range opts {
+		option(&op)
+	}
+	if op.metaTags {
+		op.tagCodec = mergedMetaTagCodec{codec: op.tagCodec, precedence: op.metaPrecedence}
+	}
+
+	r := &consulResolver{
+		consulClient: client,
+		opts:         op,
+		watchers:     make(map[string]*serviceWatcher),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	if op.snapshotDir != "" {
+		r.snapshot = newSnapshotStore(op.snapshotDir, op.snapshotMaxAge)
+	}
+	return r
 }
 
 // Target return a description for the given target that is suitable for being a key for cache.
@@ -65,28 +373,165 @@ func (c *consulResolver) Target(_ context.Context, target rpcinfo.EndpointInfo)
 }
 
 // Resolve a service info by desc.
-func (c *consulResolver) Resolve(_ context.Context, desc string) (discovery.Result, error) {
-	var eps []discovery.Instance
-	agentServiceList, _, err := c.consulClient.Health().Service(desc, "", true, nil)
+func (c *consulResolver) Resolve(ctx context.Context, desc string) (discovery.Result, error) {
+	result, err := c.resolve(ctx, desc)
+	if errors.Is(err, ErrResolverClosed) {
+		return result, err
+	}
+	if c.opts.lastKnownGood {
+		result, err = c.lkg.apply(desc, result, err, c.opts.maxStaleness)
+	}
+	if c.snapshot != nil {
+		result, err = c.snapshot.apply(desc, result, err)
+	}
+	if c.opts.slowStart && err == nil {
+		result = c.slowStart().apply(result)
+	}
+	return result, err
+}
+
+// resolve resolves the service in the primary datacenter,
+// and tries the failover datacenters in order if the primary one has no instance.
+func (c *consulResolver) resolve(ctx context.Context, desc string) (discovery.Result, error) {
+	result, err := c.resolvePrimary(ctx, desc)
+	if (err == nil && len(result.Instances) > 0) || c.opts.preparedQuery || errors.Is(err, ErrResolverClosed) {
+		return result, err
+	}
+
+	dcs, ferr := c.failoverDatacenters()
+	if ferr != nil {
+		klog.Warnf("get failover datacenters of service %s failed, err=%v", desc, ferr)
+	}
+	for _, dc := range dcs {
+		q := c.newQueryOptions()
+		q.Datacenter = dc
+		entries, _, qerr := c.query(desc, q)
+		if qerr != nil {
+			klog.Warnf("resolve service %s in failover datacenter %s failed, err=%v", desc, dc, qerr)
+			continue
+		}
+		if r, rerr := c.buildResult(desc, dc, entries); rerr == nil && len(r.Instances) > 0 {
+			return r, nil
+		}
+	}
+
+	return result, err
+}
+
+// resolvePrimary resolves the service in the primary datacenter.
+func (c *consulResolver) resolvePrimary(ctx context.Context, desc string) (discovery.Result, error) {
+	if c.opts.preparedQuery {
+		return c.resolvePreparedQuery(desc)
+	}
+	if c.opts.watch {
+		w := c.getWatcher(desc)
+		if w == nil {
+			return discovery.Result{}, ErrResolverClosed
+		}
+		return w.resolve(ctx)
+	}
+
+	entries, _, err := c.query(desc, c.newQueryOptions())
 	if err != nil {
 		return discovery.Result{}, err
 	}
-	if len(agentServiceList) == 0 {
-		return discovery.Result{}, errors.New("no service found")
+	return c.buildResult(desc, c.opts.datacenter, entries)
+}
+
+// resolvePreparedQuery executes the prepared query named desc.
+func (c *consulResolver) resolvePreparedQuery(desc string) (discovery.Result, error) {
+	q := c.newQueryOptions()
+	q.Filter = ""
+	resp, _, err := c.consulClient.PreparedQuery().Execute(desc, q)
+	if err != nil {
+		return discovery.Result{}, err
+	}
+
+	entries := make([]*api.ServiceEntry, 0, len(resp.Nodes))
+	for i := range resp.Nodes {
+		entries = append(entries, &resp.Nodes[i])
+	}
+	return c.buildResult(desc, resp.Datacenter, entries)
+}
+
+// newQueryOptions returns the query options built from the resolver options.
+func (c *consulResolver) newQueryOptions() *api.QueryOptions {
+	return &api.QueryOptions{
+		Datacenter:        c.opts.datacenter,
+		AllowStale:        c.opts.allowStale,
+		RequireConsistent: c.opts.requireConsistent,
+		UseCache:          c.opts.useCache,
+		MaxAge:            c.opts.maxAge,
+		NodeMeta:          c.opts.nodeMeta,
+		Near:              c.opts.near,
+		Filter:            c.opts.filter,
+	}
+}
+
+// query fetches the healthy entries of the service from consul.
+func (c *consulResolver) query(desc string, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	return c.consulClient.Health().ServiceMultipleTags(desc, c.opts.tags, !c.opts.warningInstances, q)
+}
+
+// buildResult converts the service entries queried in the datacenter dc into a discovery result.
+func (c *consulResolver) buildResult(desc, dc string, entries []*api.ServiceEntry) (discovery.Result, error) {
+	if len(entries) == 0 {
+		return discovery.Result{}, ErrNoServiceFound
 	}
 
-	for _, i := range agentServiceList {
+	var eps []discovery.Instance
+	for _, i := range entries {
 		svc := i.Service
-		if svc == nil || svc.Address == "" {
+		if svc == nil {
+			continue
+		}
+		meta, published := splitReservedMeta(svc.Meta)
+		network := defaultNetwork
+		if v := published[NetworkTagKey]; v != "" {
+			network = v
+		}
+		if !c.acceptsNetwork(network) {
 			continue
 		}
+		var address string
+		if isUnixNetwork(network) {
+			address = svc.Address
+		} else if host, port := c.instanceAddress(i, dc); host != "" {
+			address = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		if address == "" {
+			continue
+		}
+
+		weight := svc.Weights.Passing
+		if c.opts.warningInstances {
+			switch i.Checks.AggregatedStatus() {
+			case api.HealthPassing:
+			case api.HealthWarning:
+				weight = svc.Weights.Warning
+			default:
+				continue
+			}
+		}
+
+		tags := c.opts.tagCodec.Decode(svc.Tags, meta)
+		// the values published by the registry take precedence over the tags of the service, which keeps its dc tag
+		for k, v := range published {
+			tags[k] = v
+		}
+		if _, ok := tags[DatacenterTagKey]; !ok {
+			if i.Node != nil && i.Node.Datacenter != "" {
+				tags[DatacenterTagKey] = i.Node.Datacenter
+			} else if dc != "" {
+				tags[DatacenterTagKey] = dc
+			}
+		}
 
-		eps = append(eps, discovery.NewInstance(
-			defaultNetwork,
-			fmt.Sprint(svc.Address, ":", svc.Port),
-			svc.Weights.Passing,
-			splitTags(svc.Tags),
-		))
+		eps = append(eps, discovery.NewInstance(network, address, weight, tags))
+	}
+	if len(eps) == 0 {
+		// every entry is filtered out, e.g. critical with WithWarningInstances
+		return discovery.Result{}, ErrNoServiceFound
 	}
 
 	return discovery.Result{
@@ -96,6 +541,33 @@ func (c *consulResolver) Resolve(_ context.Context, desc string) (discovery.Resu
 	}, nil
 }
 
+// serviceAddress returns the address of the service matching the IP preference of the resolver.
+func (c *consulResolver) serviceAddress(svc *api.AgentService) (string, int) {
+	var key string
+	switch c.opts.ipPreference {
+	case PreferIPv4:
+		key = taggedLANIPv4
+	case PreferIPv6:
+		key = taggedLANIPv6
+	}
+	if tagged, ok := svc.TaggedAddresses[key]; ok && tagged.Address != "" {
+		if tagged.Port == 0 {
+			return tagged.Address, svc.Port
+		}
+		return tagged.Address, tagged.Port
+	}
+	return svc.Address, svc.Port
+}
+
+// slowStart returns the slow start built from the resolver options.
+func (c *consulResolver) slowStart() slowStart {
+	aggression := c.opts.slowStartAggression
+	if aggression <= 0 {
+		aggression = 1
+	}
+	return slowStart{window: c.opts.slowStartWindow, aggression: aggression, now: time.Now}
+}
+
 // Diff computes the difference between two results.
 func (c *consulResolver) Diff(cacheKey string, prev, next discovery.Result) (discovery.Change, bool) {
 	return discovery.DefaultDiff(cacheKey, prev, next)
@@ -122,6 +594,9 @@ func splitTags(tags []string) map[string]string {
 		if len(strArr) == 2 {
 			key := strArr[0]
 			tagMap[key] = strArr[1]
+		} else {
+			// plain consul tags set by other tools are kept as keys with empty values
+			tagMap[tag] = ""
 		}
 	}
 
@@ -17,8 +17,17 @@
 package consul
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestSplitTags(t *testing.T) {
@@ -51,6 +60,13 @@ func TestSplitTags(t *testing.T) {
 			},
 			want: map[string]string{"k1": "v1:vv1", "k2": "v2"},
 		},
+		{
+			name: "Plain tags are kept as keys",
+			args: args{
+				tags: []string{"primary", "k2:v2"},
+			},
+			want: map[string]string{"primary": "", "k2": "v2"},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -60,3 +76,122 @@ func TestSplitTags(t *testing.T) {
 		})
 	}
 }
+
+func TestNewQueryOptions(t *testing.T) {
+	r := newConsulResolver(nil,
+		WithDatacenter("dc2"),
+		WithFilter(`Service.Meta.env == "prod"`),
+		WithRequireConsistent(),
+		WithAllowStale(),
+		WithCache(time.Minute),
+		WithNodeMeta(map[string]string{"rack": "r1"}),
+	)
+	want := &api.QueryOptions{
+		Datacenter: "dc2",
+		AllowStale: true,
+		UseCache:   true,
+		MaxAge:     time.Minute,
+		NodeMeta:   map[string]string{"rack": "r1"},
+		Filter:     `Service.Meta.env == "prod"`,
+	}
+	if got := r.newQueryOptions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("newQueryOptions() = %v, want %v", got, want)
+	}
+}
+
+func TestResolvePreparedQuery(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/query/svc-pq/execute" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := json.Marshal(&api.PreparedQueryExecuteResponse{
+			Service:    "svc.watch",
+			Datacenter: "dc2",
+			Nodes:      []api.ServiceEntry{*fakeServiceEntry("10.0.2.1", 8080)},
+		})
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	r, err := NewConsulResolverWithConfig(&api.Config{Address: strings.TrimPrefix(srv.URL, "http://")},
+		WithPreparedQuery(), WithWatch(0))
+	assert.Nil(t, err)
+
+	result, err := r.Resolve(context.Background(), "svc-pq")
+	assert.Nil(t, err)
+	assert.Equal(t, "svc-pq", result.CacheKey)
+	if assert.Equal(t, 1, len(result.Instances)) {
+		ins := result.Instances[0]
+		assert.Equal(t, "10.0.2.1:8080", ins.Address().String())
+		v, _ := ins.Tag("k1")
+		assert.Equal(t, "v1", v)
+		dc, _ := ins.Tag(DatacenterTagKey)
+		assert.Equal(t, "dc2", dc)
+	}
+
+	_, err = r.Resolve(context.Background(), "unknown")
+	assert.NotNil(t, err)
+}
+
+func TestBuildResultWithWarningInstances(t *testing.T) {
+	newEntry := func(addr string, status string) *api.ServiceEntry {
+		entry := fakeServiceEntry(addr, 8080)
+		entry.Checks = api.HealthChecks{{Status: api.HealthPassing}, {Status: status}}
+		return entry
+	}
+	entries := []*api.ServiceEntry{
+		newEntry("10.0.0.1", api.HealthPassing),
+		newEntry("10.0.0.2", api.HealthWarning),
+		newEntry("10.0.0.3", api.HealthCritical),
+		newEntry("10.0.0.4", api.HealthMaint),
+	}
+
+	r := newConsulResolver(nil, WithWarningInstances())
+	result, err := r.buildResult("svc.watch", "", entries)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(result.Instances)) {
+		assert.Equal(t, "10.0.0.1:8080", result.Instances[0].Address().String())
+		assert.Equal(t, 10, result.Instances[0].Weight())
+		assert.Equal(t, "10.0.0.2:8080", result.Instances[1].Address().String())
+		assert.Equal(t, 1, result.Instances[1].Weight())
+	}
+
+	_, err = r.buildResult("svc.watch", "", []*api.ServiceEntry{
+		newEntry("10.0.0.3", api.HealthCritical),
+		newEntry("10.0.0.4", api.HealthMaint),
+	})
+	assert.Equal(t, ErrNoServiceFound, err)
+}
+
+func TestBuildResultWithIPPreference(t *testing.T) {
+	dualStack := fakeServiceEntry("10.0.0.1", 8080)
+	dualStack.Service.TaggedAddresses = map[string]api.ServiceAddress{
+		taggedLANIPv4: {Address: "10.0.0.1", Port: 8080},
+		taggedLANIPv6: {Address: "fd00::1", Port: 8080},
+	}
+	ipv6Only := fakeServiceEntry("fd00::2", 8080)
+	entries := []*api.ServiceEntry{dualStack, ipv6Only}
+
+	tests := []struct {
+		name string
+		pref IPPreference
+		want []string
+	}{
+		{name: "Default", pref: DualStack, want: []string{"10.0.0.1:8080", "[fd00::2]:8080"}},
+		{name: "IPv4", pref: PreferIPv4, want: []string{"10.0.0.1:8080", "[fd00::2]:8080"}},
+		{name: "IPv6", pref: PreferIPv6, want: []string{"[fd00::1]:8080", "[fd00::2]:8080"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newConsulResolver(nil, WithResolverIPPreference(tt.pref))
+			result, err := r.buildResult("svc.watch", "", entries)
+			assert.Nil(t, err)
+			var addrs []string
+			for _, ins := range result.Instances {
+				addrs = append(addrs, ins.Address().String())
+			}
+			assert.Equal(t, tt.want, addrs)
+		})
+	}
+}
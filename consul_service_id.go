@@ -0,0 +1,140 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/cloudwego/kitex/pkg/registry"
+)
+
+// ServiceIDGenerator generates the consul service ID of info, which is advertised at host and port.
+// It must return the same ID for the same info, since the ID is used by Register and Deregister.
+// For the services listening on Unix domain sockets, host is derived from the socket path so that it can be used
+// in URL paths, e.g. "_tmp_svc.sock-7f30ed34" for "/tmp/svc.sock", and port is 0.
+type ServiceIDGenerator func(info *registry.Info, host string, port int) (string, error)
+
+// ServiceIDTemplateData is the data of the template of TemplateServiceIDGenerator.
+type ServiceIDTemplateData struct {
+	ServiceName string
+	Host        string
+	Port        int
+	Hostname    string
+	PID         int
+	Tags        map[string]string
+}
+
+// generateServiceID returns the service ID of info registered at addr.
+func (c *consulRegistry) generateServiceID(info *registry.Info, addr serviceAddr) (string, error) {
+	host := addr.host
+	if isUnixNetwork(addr.network) {
+		host = socketIDHost(host)
+	}
+	return c.opts.serviceID(info, host, addr.port)
+}
+
+// DefaultServiceIDGenerator returns the default ServiceIDGenerator, which generates `name:host:port`.
+func DefaultServiceIDGenerator() ServiceIDGenerator {
+	return func(info *registry.Info, host string, port int) (string, error) {
+		return fmt.Sprintf("%s:%s:%d", info.ServiceName, host, port), nil
+	}
+}
+
+// HostnamePIDServiceIDGenerator returns a ServiceIDGenerator which generates `name:hostname:pid:port`,
+// so that instances behind NAT advertising the same address do not collide.
+func HostnamePIDServiceIDGenerator() ServiceIDGenerator {
+	return func(info *registry.Info, _ string, port int) (string, error) {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s:%s:%d:%d", info.ServiceName, hostname, os.Getpid(), port), nil
+	}
+}
+
+// UUIDServiceIDGenerator returns a ServiceIDGenerator which generates `name:uuid`, where uuid is random
+// and kept for the lifetime of the process for the same service name and address.
+func UUIDServiceIDGenerator() ServiceIDGenerator {
+	var (
+		mu    sync.Mutex
+		uuids = make(map[string]string)
+	)
+	return func(info *registry.Info, host string, port int) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		key := fmt.Sprintf("%s:%s:%d", info.ServiceName, host, port)
+		id, ok := uuids[key]
+		if !ok {
+			uuid, err := generateUUID()
+			if err != nil {
+				return "", err
+			}
+			id = info.ServiceName + ":" + uuid
+			uuids[key] = id
+		}
+		return id, nil
+	}
+}
+
+// TemplateServiceIDGenerator returns a ServiceIDGenerator which executes the text/template text
+// with ServiceIDTemplateData, e.g. `{{.ServiceName}}-{{.Hostname}}-{{.Port}}`.
+func TemplateServiceIDGenerator(text string) ServiceIDGenerator {
+	tmpl, parseErr := template.New("service-id").Option("missingkey=error").Parse(text)
+	return func(info *registry.Info, host string, port int) (string, error) {
+		if parseErr != nil {
+			return "", fmt.Errorf("parse service id template failed, cause %w", parseErr)
+		}
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", err
+		}
+
+		var sb strings.Builder
+		err = tmpl.Execute(&sb, &ServiceIDTemplateData{
+			ServiceName: info.ServiceName,
+			Host:        host,
+			Port:        port,
+			Hostname:    hostname,
+			PID:         os.Getpid(),
+			Tags:        info.Tags,
+		})
+		if err != nil {
+			return "", err
+		}
+		if sb.Len() == 0 {
+			return "", fmt.Errorf("service id template %q generates an empty id", text)
+		}
+		return sb.String(), nil
+	}
+}
+
+// generateUUID generates a random version 4 UUID.
+func generateUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/cloudwego/kitex/pkg/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceIDGenerator(t *testing.T) {
+	info := &registry.Info{ServiceName: "svc", Tags: map[string]string{"zone": "z1"}}
+	hostname, _ := os.Hostname()
+
+	id, err := DefaultServiceIDGenerator()(info, "10.0.0.1", 8080)
+	assert.Nil(t, err)
+	assert.Equal(t, "svc:10.0.0.1:8080", id)
+
+	id, err = HostnamePIDServiceIDGenerator()(info, "10.0.0.1", 8080)
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("svc:%s:%d:8080", hostname, os.Getpid()), id)
+
+	gen := UUIDServiceIDGenerator()
+	id, err = gen(info, "10.0.0.1", 8080)
+	assert.Nil(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^svc:[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), id)
+	again, _ := gen(info, "10.0.0.1", 8080)
+	assert.Equal(t, id, again)
+	other, _ := gen(info, "10.0.0.1", 8081)
+	assert.NotEqual(t, id, other)
+
+	id, err = TemplateServiceIDGenerator("{{.ServiceName}}-{{.Hostname}}-{{.Port}}-{{index .Tags \"zone\"}}")(info, "10.0.0.1", 8080)
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("svc-%s-8080-z1", hostname), id)
+
+	_, err = TemplateServiceIDGenerator("{{.ServiceName")(info, "10.0.0.1", 8080)
+	assert.NotNil(t, err)
+	_, err = TemplateServiceIDGenerator("")(info, "10.0.0.1", 8080)
+	assert.NotNil(t, err)
+}
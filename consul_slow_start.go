@@ -0,0 +1,174 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/cloudwego/kitex/pkg/discovery"
+	"github.com/cloudwego/kitex/pkg/registry"
+)
+
+// consul service meta keys published by the registry, they are not decoded into the tags of instances.
+const (
+	startTimeMetaKey = "kitex-start-time"
+	warmupMetaKey    = "kitex-warmup"
+)
+
+// instance tag keys set by the resolver from the consul service meta published by the registry,
+// they override the tags of the service with the same keys.
+const (
+	// StartTimeTagKey is the instance tag key holding the start time of the instance, in RFC 3339 format.
+	StartTimeTagKey = "start_time"
+	// WarmupTagKey is the instance tag key holding the warmup duration of registry.Info, e.g. "1m0s".
+	WarmupTagKey = "warmup"
+)
+
+// reservedMetaKeys are the consul service meta keys published by the registry.
+var reservedMetaKeys = map[string]string{
+	startTimeMetaKey: StartTimeTagKey,
+	warmupMetaKey:    WarmupTagKey,
+	networkMetaKey:   NetworkTagKey,
+}
+
+// validateUserMeta checks that the meta encoded from the tags of a service does not use the reserved keys.
+func validateUserMeta(meta map[string]string) error {
+	for k := range meta {
+		if _, ok := reservedMetaKeys[k]; ok {
+			return fmt.Errorf("%w: key %q is reserved by the registry", errInvalidMeta, k)
+		}
+	}
+	return nil
+}
+
+// publishedMeta adds the start time and warmup duration of a service to meta.
+func publishedMeta(startTime time.Time, warmup time.Duration, meta map[string]string) map[string]string {
+	if startTime.IsZero() && warmup <= 0 {
+		return meta
+	}
+	if meta == nil {
+		meta = make(map[string]string, 2)
+	}
+	if !startTime.IsZero() {
+		meta[startTimeMetaKey] = startTime.UTC().Format(time.RFC3339Nano)
+	}
+	if warmup > 0 {
+		meta[warmupMetaKey] = warmup.String()
+	}
+	return meta
+}
+
+// startTime returns the start time of info published for the service svcID.
+// Kitex servers do not always set the start time of registry.Info, the time the service was first registered
+// is used instead, so that it is kept when the service is registered again until it is deregistered.
+func (c *consulRegistry) startTime(svcID string, info *registry.Info) time.Time {
+	if !info.StartTime.IsZero() {
+		return info.StartTime
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if svc, ok := c.services[svcID]; ok && !svc.startTime.IsZero() {
+		return svc.startTime
+	}
+	return time.Now()
+}
+
+// splitReservedMeta returns the meta without the keys published by the registry,
+// and the instance tags converted from them.
+func splitReservedMeta(meta map[string]string) (map[string]string, map[string]string) {
+	var userMeta, reserved map[string]string
+	for k, v := range meta {
+		if tagKey, ok := reservedMetaKeys[k]; ok {
+			if reserved == nil {
+				reserved = make(map[string]string, len(reservedMetaKeys))
+			}
+			reserved[tagKey] = v
+			continue
+		}
+		if userMeta == nil {
+			userMeta = make(map[string]string, len(meta))
+		}
+		userMeta[k] = v
+	}
+	return userMeta, reserved
+}
+
+// slowStart scales the weight of instances by their age.
+type slowStart struct {
+	window     time.Duration
+	aggression float64
+	now        func() time.Time
+}
+
+// apply returns the result with the weight of the instances younger than their warmup window scaled down.
+// The result is copied if any instance is scaled, since it may be cached.
+func (s slowStart) apply(result discovery.Result) discovery.Result {
+	now := s.now()
+	var instances []discovery.Instance
+	for i, ins := range result.Instances {
+		weight, ok := s.weight(ins, now)
+		if !ok {
+			if instances != nil {
+				instances = append(instances, ins)
+			}
+			continue
+		}
+		if instances == nil {
+			instances = make([]discovery.Instance, i, len(result.Instances))
+			copy(instances, result.Instances)
+		}
+		var tags map[string]string
+		if t, ok := ins.(interface{ Tags() map[string]string }); ok {
+			tags = t.Tags()
+		}
+		instances = append(instances, discovery.NewInstance(ins.Address().Network(), ins.Address().String(), weight, tags))
+	}
+	if instances != nil {
+		result.Instances = instances
+	}
+	return result
+}
+
+// weight returns the scaled weight of ins, and false if it is not in warmup.
+func (s slowStart) weight(ins discovery.Instance, now time.Time) (int, bool) {
+	v, ok := ins.Tag(StartTimeTagKey)
+	if !ok {
+		return 0, false
+	}
+	startTime, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return 0, false
+	}
+	window := s.window
+	if v, ok := ins.Tag(WarmupTagKey); ok {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			window = d
+		}
+	}
+	age := now.Sub(startTime)
+	if window <= 0 || age >= window {
+		return 0, false
+	}
+	if age < 0 {
+		// the clocks of the client and the instance are skewed
+		age = 0
+	}
+	f := math.Pow(float64(age)/float64(window), 1/s.aggression)
+	return scaleWeight(ins.Weight(), f), true
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/kitex/pkg/discovery"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishedMeta(t *testing.T) {
+	startTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	meta := publishedMeta(startTime, time.Minute, map[string]string{"k1": "v1"})
+	assert.Equal(t, map[string]string{
+		"k1":             "v1",
+		startTimeMetaKey: "2024-01-02T03:04:05Z",
+		warmupMetaKey:    "1m0s",
+	}, meta)
+	assert.Nil(t, validateMeta(meta))
+
+	assert.Nil(t, publishedMeta(time.Time{}, 0, nil))
+}
+
+func TestRegisterPublishesRegistrationTime(t *testing.T) {
+	agent := newFakeAgent(t)
+	r := agent.newRegistry(t)
+	info := newTestInfo(8080)
+
+	startTime := func() string {
+		req, ok := agent.find("/v1/agent/service/register")
+		assert.True(t, ok)
+		meta, _ := req.Body["Meta"].(map[string]interface{})
+		v, _ := meta[startTimeMetaKey].(string)
+		return v
+	}
+	before := time.Now()
+	assert.Nil(t, r.Register(info))
+	first := startTime()
+	published, err := time.Parse(time.RFC3339Nano, first)
+	if assert.Nil(t, err) {
+		assert.False(t, published.Before(before.Round(0)))
+	}
+
+	// the registration time is kept when the service is registered again
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, r.Register(info))
+	assert.Equal(t, first, startTime())
+
+	// the start time of registry.Info takes precedence
+	info.StartTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Nil(t, r.Register(info))
+	assert.Equal(t, "2024-01-02T03:04:05Z", startTime())
+	assert.Nil(t, r.Deregister(info))
+}
+
+func TestBuildResultWithPublishedMeta(t *testing.T) {
+	entry := fakeServiceEntry("10.0.0.1", 8080)
+	entry.Service.Tags = nil
+	entry.Service.Meta = map[string]string{"k1": "v1", startTimeMetaKey: "2024-01-02T03:04:05Z"}
+
+	r := newConsulResolver(nil, WithResolverTagCodec(MetaTagCodec()))
+	result, err := r.buildResult("svc.watch", "", []*api.ServiceEntry{entry})
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(result.Instances)) {
+		tags := result.Instances[0].(interface{ Tags() map[string]string }).Tags()
+		assert.Equal(t, map[string]string{"k1": "v1", StartTimeTagKey: "2024-01-02T03:04:05Z"}, tags)
+	}
+}
+
+func TestBuildResultTagCollisions(t *testing.T) {
+	entry := fakeServiceEntry("10.0.0.1", 8080)
+	entry.Node = &api.Node{Datacenter: "dc1"}
+	entry.Service.Tags = []string{"dc:rack-1", "start_time:never"}
+	entry.Service.Meta = map[string]string{startTimeMetaKey: "2024-01-02T03:04:05Z", warmupMetaKey: "1m0s"}
+
+	r := newConsulResolver(nil)
+	result, err := r.buildResult("svc.watch", "", []*api.ServiceEntry{entry})
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(result.Instances)) {
+		tags := result.Instances[0].(interface{ Tags() map[string]string }).Tags()
+		assert.Equal(t, map[string]string{
+			DatacenterTagKey: "rack-1",
+			StartTimeTagKey:  "2024-01-02T03:04:05Z",
+			WarmupTagKey:     "1m0s",
+		}, tags)
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	newInstance := func(addr string, age time.Duration, warmup string) discovery.Instance {
+		tags := map[string]string{StartTimeTagKey: now.Add(-age).Format(time.RFC3339Nano)}
+		if warmup != "" {
+			tags[WarmupTagKey] = warmup
+		}
+		return discovery.NewInstance("tcp", addr, 100, tags)
+	}
+	result := discovery.Result{
+		Cacheable: true,
+		CacheKey:  "svc",
+		Instances: []discovery.Instance{
+			discovery.NewInstance("tcp", "10.0.0.1:8080", 100, nil),
+			newInstance("10.0.0.2:8080", 15*time.Second, ""),
+			newInstance("10.0.0.3:8080", time.Minute, ""),
+			newInstance("10.0.0.4:8080", 15*time.Second, "30s"),
+			newInstance("10.0.0.5:8080", -time.Second, ""),
+		},
+	}
+
+	tests := []struct {
+		name       string
+		aggression float64
+		want       []int
+	}{
+		{name: "Linear", aggression: 1, want: []int{100, 25, 100, 50, 1}},
+		{name: "Aggressive", aggression: 2, want: []int{100, 50, 100, 70, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := slowStart{window: time.Minute, aggression: tt.aggression, now: func() time.Time { return now }}
+			got := s.apply(result)
+			var weights []int
+			for _, ins := range got.Instances {
+				weights = append(weights, ins.Weight())
+			}
+			assert.Equal(t, tt.want, weights)
+			assert.Equal(t, "10.0.0.4:8080", got.Instances[3].Address().String())
+			// the original result is not modified
+			assert.Equal(t, 100, result.Instances[1].Weight())
+		})
+	}
+}
+
+func TestRegisterValidatesPublishedMeta(t *testing.T) {
+	agent := newFakeAgent(t)
+	r := agent.newRegistry(t, WithMetaTags())
+
+	info := newTestInfo(8080)
+	info.Tags = map[string]string{startTimeMetaKey: "2024-01-02T03:04:05Z"}
+	err := r.Register(info)
+	assert.True(t, errors.Is(err, errInvalidMeta))
+
+	// the user tags fit in the limit of consul meta, but not with the published start time
+	info.Tags = make(map[string]string, metaMaxKeyPairs)
+	for i := 0; i < metaMaxKeyPairs; i++ {
+		info.Tags["k"+strconv.Itoa(i)] = "v"
+	}
+	err = r.Register(info)
+	assert.True(t, errors.Is(err, errInvalidMeta))
+
+	_, ok := agent.find("/v1/agent/service/register")
+	assert.False(t, ok)
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cloudwego/kitex/pkg/discovery"
+	"github.com/cloudwego/kitex/pkg/klog"
+)
+
+// snapshotVersion is the version of the snapshot file format.
+const snapshotVersion = 1
+
+// snapshotFile is the content of a snapshot file.
+type snapshotFile struct {
+	Version   int                `json:"version"`
+	Service   string             `json:"service"`
+	UpdatedAt time.Time          `json:"updated_at"`
+	Instances []snapshotInstance `json:"instances"`
+}
+
+type snapshotInstance struct {
+	Network string            `json:"network"`
+	Address string            `json:"address"`
+	Weight  int               `json:"weight"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+// snapshotStore persists the resolved instances of each service into a directory,
+// one JSON file per service, so that clients can start while consul can not be reached.
+type snapshotStore struct {
+	dir string
+	// maxAge is the age beyond which a snapshot is not served, it is served whatever its age if not positive.
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	written map[string][]byte
+}
+
+func newSnapshotStore(dir string, maxAge time.Duration) *snapshotStore {
+	return &snapshotStore{
+		dir:     dir,
+		maxAge:  maxAge,
+		written: make(map[string][]byte),
+	}
+}
+
+// apply saves the result if it succeeded, or replaces the error with the snapshot on disk
+// if consul could not be reached and the snapshot is not older than maxAge.
+func (s *snapshotStore) apply(key string, result discovery.Result, err error) (discovery.Result, error) {
+	if err == nil {
+		if serr := s.save(key, result); serr != nil {
+			klog.Warnf("save snapshot of service %s failed, err=%v", key, serr)
+		}
+		return result, nil
+	}
+	if errors.Is(err, ErrNoServiceFound) {
+		if serr := s.remove(key); serr != nil {
+			klog.Warnf("remove snapshot of service %s failed, err=%v", key, serr)
+		}
+		return result, err
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return result, err
+	}
+
+	snapshot, updatedAt, lerr := s.load(key)
+	if lerr != nil {
+		if !os.IsNotExist(lerr) {
+			klog.Warnf("load snapshot of service %s failed, err=%v", key, lerr)
+		}
+		return result, err
+	}
+	age := time.Since(updatedAt)
+	if s.maxAge > 0 && age > s.maxAge {
+		klog.Warnf("resolve service %s from consul failed, snapshot updated %v ago at %v is older than %v, err=%v",
+			key, age, updatedAt, s.maxAge, err)
+		return result, err
+	}
+	klog.Warnf("resolve service %s from consul failed, serve snapshot updated %v ago at %v, err=%v",
+		key, age, updatedAt, err)
+	return snapshot, nil
+}
+
+// save writes the result into the snapshot file of key, if it changed since the last write.
+func (s *snapshotStore) save(key string, result discovery.Result) error {
+	instances := make([]snapshotInstance, 0, len(result.Instances))
+	for _, ins := range result.Instances {
+		si := snapshotInstance{
+			Network: ins.Address().Network(),
+			Address: ins.Address().String(),
+			Weight:  ins.Weight(),
+		}
+		if t, ok := ins.(interface{ Tags() map[string]string }); ok {
+			si.Tags = t.Tags()
+		}
+		instances = append(instances, si)
+	}
+	content, err := json.Marshal(instances)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if bytes.Equal(s.written[key], content) {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(&snapshotFile{
+		Version:   snapshotVersion,
+		Service:   key,
+		UpdatedAt: time.Now(),
+		Instances: instances,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+
+	err = s.withLock(key, true, func() error {
+		tmp, err := os.CreateTemp(s.dir, ".snapshot-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		if _, err = tmp.Write(data); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err = tmp.Close(); err != nil {
+			return err
+		}
+		return os.Rename(tmp.Name(), s.path(key))
+	})
+	if err != nil {
+		return err
+	}
+	s.written[key] = content
+	return nil
+}
+
+// load reads the snapshot file of key.
+func (s *snapshotStore) load(key string) (discovery.Result, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var file snapshotFile
+	err := s.withLock(key, false, func() error {
+		data, err := os.ReadFile(s.path(key))
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, &file)
+	})
+	if err != nil {
+		return discovery.Result{}, time.Time{}, err
+	}
+	if file.Version != snapshotVersion {
+		return discovery.Result{}, time.Time{}, fmt.Errorf("unsupported snapshot version %d", file.Version)
+	}
+	instances := make([]discovery.Instance, 0, len(file.Instances))
+	for _, si := range file.Instances {
+		instances = append(instances, discovery.NewInstance(si.Network, si.Address, si.Weight, si.Tags))
+	}
+	return discovery.Result{
+		Cacheable: true,
+		CacheKey:  key,
+		Instances: instances,
+	}, file.UpdatedAt, nil
+}
+
+// remove removes the snapshot file of key.
+func (s *snapshotStore) remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.written, key)
+	err := s.withLock(key, true, func() error {
+		return os.Remove(s.path(key))
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// withLock runs fn while holding the file lock of key, which is shared among processes.
+func (s *snapshotStore) withLock(key string, exclusive bool, fn func() error) error {
+	f, err := os.OpenFile(s.path(key)+".lock", os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = lockFile(f, exclusive); err != nil {
+		return err
+	}
+	defer unlockFile(f)
+	return fn()
+}
+
+func (s *snapshotStore) path(key string) string {
+	return filepath.Join(s.dir, url.PathEscape(key)+".json")
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/kitex/pkg/discovery"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotStore(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		errDown = errors.New("connection refused")
+		good    = discovery.Result{
+			Cacheable: true,
+			CacheKey:  "svc/a",
+			Instances: []discovery.Instance{discovery.NewInstance("tcp", "10.0.0.1:8080", 10, map[string]string{"k1": "v1"})},
+		}
+	)
+
+	s := newSnapshotStore(dir, 0)
+	_, err := s.apply("svc/a", discovery.Result{}, errDown)
+	assert.Equal(t, errDown, err)
+
+	_, err = s.apply("svc/a", good, nil)
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "svc%2Fa.json"))
+	assert.Nil(t, err)
+
+	// a new process loads the snapshot written by the previous one
+	got, err := newSnapshotStore(dir, 0).apply("svc/a", discovery.Result{}, errDown)
+	assert.Nil(t, err)
+	assert.Equal(t, "svc/a", got.CacheKey)
+	if assert.Equal(t, 1, len(got.Instances)) {
+		ins := got.Instances[0]
+		assert.Equal(t, "tcp", ins.Address().Network())
+		assert.Equal(t, "10.0.0.1:8080", ins.Address().String())
+		assert.Equal(t, 10, ins.Weight())
+		v, _ := ins.Tag("k1")
+		assert.Equal(t, "v1", v)
+	}
+
+	// the service genuinely has no instance
+	_, err = s.apply("svc/a", discovery.Result{}, ErrNoServiceFound)
+	assert.Equal(t, ErrNoServiceFound, err)
+	_, err = s.apply("svc/a", discovery.Result{}, errDown)
+	assert.Equal(t, errDown, err)
+}
+
+func TestSnapshotMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	errDown := errors.New("connection refused")
+	data, err := json.Marshal(&snapshotFile{
+		Version:   snapshotVersion,
+		Service:   "svc/a",
+		UpdatedAt: time.Now().Add(-2 * time.Hour),
+		Instances: []snapshotInstance{{Network: "tcp", Address: "10.0.0.1:8080", Weight: 10}},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "svc%2Fa.json"), data, 0o644))
+
+	// the snapshot is served whatever its age by default
+	got, err := newSnapshotStore(dir, 0).apply("svc/a", discovery.Result{}, errDown)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(got.Instances))
+
+	got, err = newSnapshotStore(dir, 3*time.Hour).apply("svc/a", discovery.Result{}, errDown)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(got.Instances))
+
+	_, err = newSnapshotStore(dir, time.Hour).apply("svc/a", discovery.Result{}, errDown)
+	assert.Equal(t, errDown, err)
+}
+
+func TestResolveFromSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	s := newSnapshotStore(dir, 0)
+	_, err := s.apply("svc.snapshot", discovery.Result{
+		Cacheable: true,
+		CacheKey:  "svc.snapshot",
+		Instances: []discovery.Instance{discovery.NewInstance("tcp", "10.0.0.1:8080", 10, nil)},
+	}, nil)
+	assert.Nil(t, err)
+
+	// nothing listens on this address
+	r, err := NewConsulResolverWithConfig(&consulapi.Config{Address: "127.0.0.1:1"}, WithSnapshotDir(dir))
+	assert.Nil(t, err)
+	result, err := r.Resolve(context.Background(), "svc.snapshot")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(result.Instances))
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// limits of consul service meta.
+const (
+	metaMaxKeyPairs       = 64
+	metaKeyMaxLength      = 128
+	metaValueMaxLength    = 512
+	metaKeyReservedPrefix = "consul-"
+)
+
+var (
+	metaKeyFormat = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+	errInvalidMeta = errors.New("invalid consul meta")
+)
+
+// MetaPrecedence decides which value is used when a key is both in consul tags and consul meta.
+type MetaPrecedence int
+
+const (
+	// MetaOverTags uses the value of consul meta.
+	MetaOverTags MetaPrecedence = iota
+	// TagsOverMeta uses the value of consul tags.
+	TagsOverMeta
+)
+
+// TagCodec converts the tags of kitex instances from and to the tags and meta of consul services.
+// The same codec should be used by the registry and the resolver.
+type TagCodec interface {
+	// Encode converts the tags of registry.Info into consul service tags and meta.
+	Encode(tags map[string]string) (consulTags []string, meta map[string]string, err error)
+	// Decode converts consul service tags and meta into the tags of discovery.Instance.
+	Decode(consulTags []string, meta map[string]string) map[string]string
+}
+
+// ColonTagCodec returns the default TagCodec, which stores each tag as `k:v` in consul tags.
+// Keys must not contain `:`.
+func ColonTagCodec() TagCodec {
+	return colonTagCodec{}
+}
+
+// EscapedTagCodec returns a TagCodec which stores each tag as `k:v` in consul tags,
+// `%` and `:` in keys are escaped so that arbitrary keys round-trip.
+// It is compatible with ColonTagCodec for keys without `%`.
+func EscapedTagCodec() TagCodec {
+	return escapedTagCodec{}
+}
+
+// EqualTagCodec returns a TagCodec which stores each tag as `k=v` in consul tags.
+// Keys must not contain `=`.
+func EqualTagCodec() TagCodec {
+	return separatorTagCodec{sep: "="}
+}
+
+// MetaTagCodec returns a TagCodec which stores the tags in consul service meta instead of consul tags.
+// Consul limits the meta to 64 pairs, keys to 128 characters of letters, digits, `_` and `-`
+// without the `consul-` prefix, and values to 512 characters.
+func MetaTagCodec() TagCodec {
+	return metaTagCodec{}
+}
+
+type colonTagCodec struct{}
+
+func (colonTagCodec) Encode(tags map[string]string) ([]string, map[string]string, error) {
+	consulTags, err := convTagMapToSlice(tags)
+	return consulTags, nil, err
+}
+
+func (colonTagCodec) Decode(consulTags []string, _ map[string]string) map[string]string {
+	return splitTags(consulTags)
+}
+
+// separatorTagCodec stores each tag as key, sep and value in consul tags.
+// Consul tags without sep are decoded as keys with empty values.
+type separatorTagCodec struct {
+	sep string
+}
+
+func (c separatorTagCodec) Encode(tags map[string]string) ([]string, map[string]string, error) {
+	consulTags := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if strings.Contains(k, c.sep) {
+			return nil, nil, fmt.Errorf("%w: tag key %q contains %q", errIllegalTagChar, k, c.sep)
+		}
+		consulTags = append(consulTags, k+c.sep+v)
+	}
+	return consulTags, nil, nil
+}
+
+func (c separatorTagCodec) Decode(consulTags []string, _ map[string]string) map[string]string {
+	tags := make(map[string]string, len(consulTags))
+	for _, tag := range consulTags {
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, c.sep, 2)
+		if len(kv) == 2 {
+			tags[kv[0]] = kv[1]
+		} else {
+			tags[kv[0]] = ""
+		}
+	}
+	return tags
+}
+
+var tagKeyEscaper = strings.NewReplacer("%", "%25", kvJoinChar, "%3A")
+
+var tagKeyUnescaper = strings.NewReplacer("%25", "%", "%3A", kvJoinChar)
+
+type escapedTagCodec struct{}
+
+func (escapedTagCodec) Encode(tags map[string]string) ([]string, map[string]string, error) {
+	consulTags := make([]string, 0, len(tags))
+	for k, v := range tags {
+		consulTags = append(consulTags, tagKeyEscaper.Replace(k)+kvJoinChar+v)
+	}
+	return consulTags, nil, nil
+}
+
+func (escapedTagCodec) Decode(consulTags []string, _ map[string]string) map[string]string {
+	escaped := splitTags(consulTags)
+	tags := make(map[string]string, len(escaped))
+	for k, v := range escaped {
+		tags[tagKeyUnescaper.Replace(k)] = v
+	}
+	return tags
+}
+
+type metaTagCodec struct{}
+
+func (metaTagCodec) Encode(tags map[string]string) ([]string, map[string]string, error) {
+	if err := validateMeta(tags); err != nil {
+		return nil, nil, err
+	}
+	meta := make(map[string]string, len(tags))
+	for k, v := range tags {
+		meta[k] = v
+	}
+	return nil, meta, nil
+}
+
+func (metaTagCodec) Decode(_ []string, meta map[string]string) map[string]string {
+	tags := make(map[string]string, len(meta))
+	for k, v := range meta {
+		tags[k] = v
+	}
+	return tags
+}
+
+// mergedMetaTagCodec decodes the consul tags with codec, and merges consul meta into them.
+type mergedMetaTagCodec struct {
+	codec      TagCodec
+	precedence MetaPrecedence
+}
+
+func (c mergedMetaTagCodec) Encode(tags map[string]string) ([]string, map[string]string, error) {
+	return c.codec.Encode(tags)
+}
+
+func (c mergedMetaTagCodec) Decode(consulTags []string, meta map[string]string) map[string]string {
+	tags := c.codec.Decode(consulTags, meta)
+	for k, v := range meta {
+		if _, ok := tags[k]; ok && c.precedence == TagsOverMeta {
+			continue
+		}
+		tags[k] = v
+	}
+	return tags
+}
+
+// validateMeta checks the meta against the limits of consul.
+func validateMeta(meta map[string]string) error {
+	if len(meta) > metaMaxKeyPairs {
+		return fmt.Errorf("%w: at most %d pairs are allowed, got %d", errInvalidMeta, metaMaxKeyPairs, len(meta))
+	}
+	for k, v := range meta {
+		if len(k) > metaKeyMaxLength {
+			return fmt.Errorf("%w: key %q is longer than %d characters", errInvalidMeta, k, metaKeyMaxLength)
+		}
+		if !metaKeyFormat.MatchString(k) {
+			return fmt.Errorf("%w: key %q must only contain letters, digits, `_` and `-`", errInvalidMeta, k)
+		}
+		if strings.HasPrefix(k, metaKeyReservedPrefix) {
+			return fmt.Errorf("%w: key %q uses the reserved prefix %q", errInvalidMeta, k, metaKeyReservedPrefix)
+		}
+		if len(v) > metaValueMaxLength {
+			return fmt.Errorf("%w: value of key %q is longer than %d characters", errInvalidMeta, k, metaValueMaxLength)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTagCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec TagCodec
+		tags  map[string]string
+	}{
+		{
+			name:  "Colon",
+			codec: ColonTagCodec(),
+			tags:  map[string]string{"k1": "v1", "k2": "v2:vv2", "k3": ""},
+		},
+		{
+			name:  "Escaped",
+			codec: EscapedTagCodec(),
+			tags:  map[string]string{"k1": "v1", "k:2": "v2:vv2", "k%3A": "v3", "%": ""},
+		},
+		{
+			name:  "Equal",
+			codec: EqualTagCodec(),
+			tags:  map[string]string{"k1": "v1", "k:2": "v2=vv2"},
+		},
+		{
+			name:  "Meta",
+			codec: MetaTagCodec(),
+			tags:  map[string]string{"k1": "v1", "k-2": "v2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consulTags, meta, err := tt.codec.Encode(tt.tags)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			if got := tt.codec.Decode(consulTags, meta); !reflect.DeepEqual(got, tt.tags) {
+				t.Errorf("Decode(Encode()) = %v, want %v", got, tt.tags)
+			}
+		})
+	}
+}
+
+func TestTagCodecEncode(t *testing.T) {
+	tests := []struct {
+		name       string
+		codec      TagCodec
+		tags       map[string]string
+		consulTags []string
+		meta       map[string]string
+		illegal    bool
+	}{
+		{
+			name:       "Colon",
+			codec:      ColonTagCodec(),
+			tags:       map[string]string{"k1": "v1"},
+			consulTags: []string{"k1:v1"},
+		},
+		{
+			name:    "Colon with illegal key",
+			codec:   ColonTagCodec(),
+			tags:    map[string]string{"k:1": "v1"},
+			illegal: true,
+		},
+		{
+			name:       "Escaped",
+			codec:      EscapedTagCodec(),
+			tags:       map[string]string{"k1": "v1", "k:2": "v2", "k%3": "v3"},
+			consulTags: []string{"k%253:v3", "k%3A2:v2", "k1:v1"},
+		},
+		{
+			name:       "Equal",
+			codec:      EqualTagCodec(),
+			tags:       map[string]string{"k:1": "v1"},
+			consulTags: []string{"k:1=v1"},
+		},
+		{
+			name:    "Equal with illegal key",
+			codec:   EqualTagCodec(),
+			tags:    map[string]string{"k=1": "v1"},
+			illegal: true,
+		},
+		{
+			name:  "Meta",
+			codec: MetaTagCodec(),
+			tags:  map[string]string{"k1": "v1"},
+			meta:  map[string]string{"k1": "v1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consulTags, meta, err := tt.codec.Encode(tt.tags)
+			if tt.illegal {
+				if !errors.Is(err, errIllegalTagChar) {
+					t.Errorf("Encode() error = %v, want %v", err, errIllegalTagChar)
+				}
+				return
+			}
+			sort.Strings(consulTags)
+			if len(consulTags) != 0 || len(tt.consulTags) != 0 {
+				if !reflect.DeepEqual(consulTags, tt.consulTags) {
+					t.Errorf("Encode() consulTags = %v, want %v", consulTags, tt.consulTags)
+				}
+			}
+			if len(meta) != 0 || len(tt.meta) != 0 {
+				if !reflect.DeepEqual(meta, tt.meta) {
+					t.Errorf("Encode() meta = %v, want %v", meta, tt.meta)
+				}
+			}
+		})
+	}
+}
+
+func TestTagCodecDecodePlainTags(t *testing.T) {
+	want := map[string]string{"primary": "", "k1": "v1"}
+	for _, codec := range []TagCodec{ColonTagCodec(), EscapedTagCodec()} {
+		if got := codec.Decode([]string{"primary", "k1:v1"}, nil); !reflect.DeepEqual(got, want) {
+			t.Errorf("Decode() = %v, want %v", got, want)
+		}
+	}
+	if got := EqualTagCodec().Decode([]string{"primary", "k1=v1"}, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode() = %v, want %v", got, want)
+	}
+}
+
+func TestValidateMeta(t *testing.T) {
+	tooMany := make(map[string]string, metaMaxKeyPairs+1)
+	for i := 0; i <= metaMaxKeyPairs; i++ {
+		tooMany["k"+strconv.Itoa(i)] = "v"
+	}
+	tests := []struct {
+		name    string
+		meta    map[string]string
+		wantErr bool
+	}{
+		{name: "Valid", meta: map[string]string{"k_1": "v1", "K-2": strings.Repeat("v", metaValueMaxLength)}},
+		{name: "Too many pairs", meta: tooMany, wantErr: true},
+		{name: "Key too long", meta: map[string]string{strings.Repeat("k", metaKeyMaxLength+1): "v"}, wantErr: true},
+		{name: "Illegal key", meta: map[string]string{"k:1": "v"}, wantErr: true},
+		{name: "Empty key", meta: map[string]string{"": "v"}, wantErr: true},
+		{name: "Reserved key", meta: map[string]string{"consul-k": "v"}, wantErr: true},
+		{name: "Value too long", meta: map[string]string{"k": strings.Repeat("v", metaValueMaxLength+1)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMeta(tt.meta)
+			if tt.wantErr != (err != nil) {
+				t.Errorf("validateMeta() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errInvalidMeta) {
+				t.Errorf("validateMeta() error = %v, want %v", err, errInvalidMeta)
+			}
+		})
+	}
+}
+
+func TestMergedMetaTagCodec(t *testing.T) {
+	consulTags := []string{"k1:tag", "k2:tag"}
+	meta := map[string]string{"k2": "meta", "k3": "meta"}
+
+	codec := mergedMetaTagCodec{codec: ColonTagCodec(), precedence: MetaOverTags}
+	want := map[string]string{"k1": "tag", "k2": "meta", "k3": "meta"}
+	if got := codec.Decode(consulTags, meta); !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode() = %v, want %v", got, want)
+	}
+
+	codec = mergedMetaTagCodec{codec: ColonTagCodec(), precedence: TagsOverMeta}
+	want = map[string]string{"k1": "tag", "k2": "tag", "k3": "meta"}
+	if got := codec.Decode(consulTags, meta); !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode() = %v, want %v", got, want)
+	}
+}
@@ -426,3 +426,64 @@ func TestMultiInstancesRegister(t *testing.T) {
 		}
 	}
 }
+
+// TestRegisterDoesNotMutateCheck tests that Register does not modify the check passed to WithCheck.
+func TestRegisterDoesNotMutateCheck(t *testing.T) {
+	check := &consulapi.AgentServiceCheck{
+		Interval:                       "7s",
+		Timeout:                        "5s",
+		DeregisterCriticalServiceAfter: "15s",
+	}
+	r, err := NewConsulRegister(consulAddr, WithCheck(check))
+	assert.Nil(t, err)
+
+	testSvcAddr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", localIpAddr, 8094))
+	info := &registry.Info{
+		ServiceName: "svc.local.check",
+		Weight:      10,
+		Addr:        testSvcAddr,
+	}
+	if err = r.Register(info); err == nil {
+		defer r.Deregister(info)
+	}
+	assert.Empty(t, check.TCP)
+	assert.Empty(t, check.CheckID)
+}
+
+// TestMultiServicesRegisterWithTTL tests registering several services with TTL checks on one registry,
+// then deregister one of them while the other keeps its heartbeat.
+func TestMultiServicesRegisterWithTTL(t *testing.T) {
+	var (
+		testSvcName1 = strconv.Itoa(int(time.Now().Unix())) + ".ttl1.svc.local"
+		testSvcName2 = strconv.Itoa(int(time.Now().Unix())) + ".ttl2.svc.local"
+	)
+
+	r, err := NewConsulRegister(consulAddr, WithCheck(&consulapi.AgentServiceCheck{
+		TTL:                            "3s",
+		DeregisterCriticalServiceAfter: "1m",
+	}))
+	assert.Nil(t, err)
+
+	testSvcAddr1, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", localIpAddr, 8095))
+	info1 := &registry.Info{ServiceName: testSvcName1, Weight: 10, Addr: testSvcAddr1}
+	testSvcAddr2, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", localIpAddr, 8096))
+	info2 := &registry.Info{ServiceName: testSvcName2, Weight: 10, Addr: testSvcAddr2}
+
+	assert.Nil(t, r.Register(info1))
+	assert.Nil(t, r.Register(info2))
+	time.Sleep(time.Second * 5)
+
+	for _, name := range []string{testSvcName1, testSvcName2} {
+		list, _, err := consulClient.Health().Service(name, "", true, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(list))
+	}
+
+	assert.Nil(t, r.Deregister(info1))
+	time.Sleep(time.Second * 5)
+
+	list, _, err := consulClient.Health().Service(testSvcName2, "", true, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(list))
+	assert.Nil(t, r.Deregister(info2))
+}
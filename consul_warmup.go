@@ -0,0 +1,136 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudwego/kitex/pkg/klog"
+	"github.com/hashicorp/consul/api"
+)
+
+// warmupSteps is the number of re-registrations ramping up the weight of a service during warmup.
+const warmupSteps = 10
+
+// WarmupCurve is how the weight of a service ramps up to its registered weight during warmup.
+type WarmupCurve int
+
+const (
+	// WarmupLinear increases the weight by the same amount at each step.
+	WarmupLinear WarmupCurve = iota
+	// WarmupExponential doubles the weight at each step, so that most of the traffic arrives at the end of warmup.
+	WarmupExponential
+)
+
+// fraction returns the fraction of the registered weight at the given step of warmup.
+func (curve WarmupCurve) fraction(step, steps int) float64 {
+	if step >= steps {
+		return 1
+	}
+	switch curve {
+	case WarmupExponential:
+		return math.Pow(2, float64(step-steps))
+	default:
+		return float64(step) / float64(steps)
+	}
+}
+
+// weights returns the weights of the service at the given step of warmup, target being the registered weights.
+func (curve WarmupCurve) weights(target *api.AgentWeights, step, steps int) *api.AgentWeights {
+	f := curve.fraction(step, steps)
+	return &api.AgentWeights{
+		Passing: scaleWeight(target.Passing, f),
+		Warning: scaleWeight(target.Warning, f),
+	}
+}
+
+// scaleWeight scales weight by f, without going down to 0 since consul requires a positive passing weight.
+func scaleWeight(weight int, f float64) int {
+	w := int(float64(weight) * f)
+	if w < 1 && weight > 0 {
+		w = 1
+	}
+	return w
+}
+
+// startWarmup start a goroutine to periodically re-register the service with increasing weights,
+// until target is reached.
+func (c *consulRegistry) startWarmup(svc *registeredService, target *api.AgentWeights) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	atomic.StoreInt32(&svc.warmingUp, 1)
+	go func() {
+		defer atomic.StoreInt32(&svc.warmingUp, 0)
+		interval := c.opts.warmupPeriod / warmupSteps
+		if interval <= 0 {
+			// the period is shorter than warmupSteps nanoseconds
+			interval = time.Nanosecond
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		step := 0
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if step < warmupSteps {
+				step++
+			}
+			err := c.reweight(ctx, svc, c.opts.warmupCurve.weights(target, step, warmupSteps))
+			if err != nil {
+				// the next step is tried at the next tick, the last one until it succeeds
+				klog.Errorf("update weight of service %s to consul failed, err=%v", svc.id, err)
+				continue
+			}
+			if step == warmupSteps {
+				return
+			}
+		}
+	}()
+	return cancel
+}
+
+// reweight re-registers the service with the given weights, keeping its checks and its maintenance mode.
+func (c *consulRegistry) reweight(ctx context.Context, svc *registeredService, weights *api.AgentWeights) error {
+	unlock := c.lockService(svc.id)
+	defer unlock()
+
+	// the service has been deregistered or registered again meanwhile
+	if ctx.Err() != nil || !c.isRegistered(svc) {
+		return nil
+	}
+	registration := *svc.registration
+	registration.Weights = weights
+	if err := c.consulClient.Agent().ServiceRegister(&registration); err != nil {
+		return err
+	}
+	// passingWeight reads the registration under c.mu
+	c.mu.Lock()
+	svc.registration = &registration
+	c.mu.Unlock()
+	if err := c.restoreMaintenance(svc); err != nil {
+		return err
+	}
+
+	// re-registration resets the status of the TTL checks, they are updated without holding c.mu
+	// since the health probes may be slow
+	return c.updateTTLs(svc)
+}
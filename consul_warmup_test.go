@@ -0,0 +1,109 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarmupCurveWeights(t *testing.T) {
+	target := &api.AgentWeights{Passing: 100, Warning: 10}
+	tests := []struct {
+		name  string
+		curve WarmupCurve
+		step  int
+		want  *api.AgentWeights
+	}{
+		{name: "Linear start", curve: WarmupLinear, step: 0, want: &api.AgentWeights{Passing: 1, Warning: 1}},
+		{name: "Linear middle", curve: WarmupLinear, step: 5, want: &api.AgentWeights{Passing: 50, Warning: 5}},
+		{name: "Linear end", curve: WarmupLinear, step: 10, want: &api.AgentWeights{Passing: 100, Warning: 10}},
+		{name: "Exponential middle", curve: WarmupExponential, step: 5, want: &api.AgentWeights{Passing: 3, Warning: 1}},
+		{name: "Exponential before end", curve: WarmupExponential, step: 9, want: &api.AgentWeights{Passing: 50, Warning: 5}},
+		{name: "Exponential end", curve: WarmupExponential, step: 10, want: &api.AgentWeights{Passing: 100, Warning: 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.curve.weights(target, tt.step, warmupSteps))
+		})
+	}
+}
+
+// registeredWeights returns the passing weights of the received registrations.
+func (f *fakeAgent) registeredWeights() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var weights []int
+	for _, req := range f.requests {
+		if req.Path != "/v1/agent/service/register" {
+			continue
+		}
+		w, _ := req.Body["Weights"].(map[string]interface{})
+		passing, _ := w["Passing"].(float64)
+		weights = append(weights, int(passing))
+	}
+	return weights
+}
+
+func TestRegisterWithWarmup(t *testing.T) {
+	agent := newFakeAgent(t)
+	r := agent.newRegistry(t, WithWarmup(200*time.Millisecond, WarmupLinear), WithCheck(&api.AgentServiceCheck{TTL: "5s"}))
+	info := newTestInfo(8080)
+
+	assert.Nil(t, r.Register(info))
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, []int{1, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100}, agent.registeredWeights())
+	// the TTL check is updated after each re-registration
+	req, ok := agent.find("/v1/agent/check/update/")
+	if assert.True(t, ok) {
+		assert.Equal(t, api.HealthPassing, req.Body["Status"])
+	}
+	assert.Nil(t, r.Deregister(info))
+}
+
+func TestDeregisterCancelsWarmup(t *testing.T) {
+	agent := newFakeAgent(t)
+	r := agent.newRegistry(t, WithWarmup(time.Second, WarmupExponential))
+	info := newTestInfo(8080)
+
+	assert.Nil(t, r.Register(info))
+	time.Sleep(250 * time.Millisecond)
+	assert.Nil(t, r.Deregister(info))
+	n := len(agent.registeredWeights())
+	assert.True(t, n > 1 && n < warmupSteps+1)
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, n, len(agent.registeredWeights()))
+}
+
+func TestRegisterWithTinyWarmup(t *testing.T) {
+	agent := newFakeAgent(t)
+	r := agent.newRegistry(t, WithWarmup(5*time.Nanosecond, WarmupLinear))
+	info := newTestInfo(8080)
+
+	assert.Nil(t, r.Register(info))
+	time.Sleep(100 * time.Millisecond)
+	weights := agent.registeredWeights()
+	if assert.NotEmpty(t, weights) {
+		assert.Equal(t, 100, weights[len(weights)-1])
+	}
+	assert.Nil(t, r.Deregister(info))
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudwego/kitex/pkg/discovery"
+	"github.com/cloudwego/kitex/pkg/klog"
+)
+
+// watchIdleTimeout is how long a watcher keeps running without being resolved.
+const watchIdleTimeout = 10 * time.Minute
+
+// serviceWatcher keeps a local snapshot of a service up to date with blocking queries.
+type serviceWatcher struct {
+	desc       string
+	resolver   *consulResolver
+	lastAccess int64
+	ready      chan struct{}
+	readyOnce  sync.Once
+	// done is closed once the watch loop exits
+	done chan struct{}
+
+	mu       sync.RWMutex
+	result   discovery.Result
+	err      error
+	queryErr error
+	synced   bool
+}
+
+// getWatcher returns the watcher of desc, starting a new one if absent, or nil if the resolver is closed.
+func (c *consulResolver) getWatcher(desc string) *serviceWatcher {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ctx.Err() != nil {
+		return nil
+	}
+	w, ok := c.watchers[desc]
+	if !ok {
+		w = &serviceWatcher{
+			desc:     desc,
+			resolver: c,
+			ready:    make(chan struct{}),
+			done:     make(chan struct{}),
+		}
+		c.watchers[desc] = w
+		go w.run()
+	}
+	atomic.StoreInt64(&w.lastAccess, time.Now().UnixNano())
+	return w
+}
+
+// removeWatcherIfIdle removes w from the resolver if it has not been resolved for watchIdleTimeout,
+// or if the resolver is closed.
+func (c *consulResolver) removeWatcherIfIdle(w *serviceWatcher) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ctx.Err() == nil && time.Since(time.Unix(0, atomic.LoadInt64(&w.lastAccess))) < watchIdleTimeout {
+		return false
+	}
+	if c.watchers[w.desc] == w {
+		delete(c.watchers, w.desc)
+	}
+	return true
+}
+
+// resolve waits for the first query of the watcher and returns the current snapshot.
+func (w *serviceWatcher) resolve(ctx context.Context) (discovery.Result, error) {
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		return discovery.Result{}, ctx.Err()
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	// with WithLastKnownGood, the staleness of the snapshot is handled by the resolver
+	if w.queryErr != nil && (!w.synced || w.resolver.opts.lastKnownGood) {
+		return discovery.Result{}, w.queryErr
+	}
+	return w.result, w.err
+}
+
+// run is the watch loop, it exits once the watcher becomes idle or the resolver is closed.
+func (w *serviceWatcher) run() {
+	defer close(w.done)
+
+	c := w.resolver
+	backoff := c.opts.watchMinBackoff
+	var index uint64
+	for {
+		if c.removeWatcherIfIdle(w) {
+			if c.ctx.Err() != nil {
+				w.fail(ErrResolverClosed)
+			}
+			return
+		}
+
+		q := c.newQueryOptions().WithContext(c.ctx)
+		q.WaitIndex, q.WaitTime = index, c.opts.watchWaitTime
+		entries, meta, err := c.query(w.desc, q)
+		if c.ctx.Err() != nil {
+			continue
+		}
+		if err != nil {
+			klog.Warnf("watch service %s from consul failed, retry in %v, err=%v", w.desc, backoff, err)
+			w.fail(err)
+			select {
+			case <-time.After(jitter(backoff)):
+			case <-c.ctx.Done():
+			}
+			if backoff *= 2; backoff > c.opts.watchMaxBackoff {
+				backoff = c.opts.watchMaxBackoff
+			}
+			continue
+		}
+		backoff = c.opts.watchMinBackoff
+
+		// the index must be reset if it goes backwards, see
+		// https://developer.hashicorp.com/consul/api-docs/features/blocking#implementation-details
+		if meta.LastIndex < index {
+			index = 0
+			continue
+		}
+		if meta.LastIndex == index && w.isSynced() {
+			continue
+		}
+		index = meta.LastIndex
+
+		result, err := c.buildResult(w.desc, c.opts.datacenter, entries)
+		w.update(result, err)
+	}
+}
+
+// Close stops the watchers of the resolver started by WithWatch, and waits for them to exit.
+// Resolve returns ErrResolverClosed once the resolver is closed if WithWatch is set, the resolver
+// can be used as usual otherwise. The watchers of a resolver which is not closed stop once their service
+// has not been resolved for 10 minutes.
+func (c *consulResolver) Close() error {
+	c.cancel()
+
+	c.mu.Lock()
+	watchers := c.watchers
+	c.watchers = make(map[string]*serviceWatcher)
+	c.mu.Unlock()
+
+	for _, w := range watchers {
+		<-w.done
+	}
+	return nil
+}
+
+// update replaces the snapshot and notifies the change.
+func (w *serviceWatcher) update(result discovery.Result, err error) {
+	w.mu.Lock()
+	prev := w.result
+	w.result, w.err, w.queryErr = result, err, nil
+	w.synced = true
+	w.mu.Unlock()
+	w.markReady()
+
+	notify := w.resolver.opts.watchNotify
+	if notify == nil {
+		return
+	}
+	if change, ok := w.resolver.Diff(w.desc, prev, result); ok {
+		notify(change)
+	}
+}
+
+// fail records the error of a failed query.
+// The last snapshot is kept, and served until the next successful query unless WithLastKnownGood is set.
+func (w *serviceWatcher) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.queryErr = err
+	w.markReady()
+}
+
+// markReady unblocks the pending resolves once the first query finishes.
+func (w *serviceWatcher) markReady() {
+	w.readyOnce.Do(func() { close(w.ready) })
+}
+
+func (w *serviceWatcher) isSynced() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.synced
+}
+
+// jitter returns a random duration in [d/2, d).
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
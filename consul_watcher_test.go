@@ -0,0 +1,158 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/kitex/pkg/discovery"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeHealthServer serves /v1/health/service/ with blocking query semantics.
+type fakeHealthServer struct {
+	mu      sync.Mutex
+	index   uint64
+	entries []*consulapi.ServiceEntry
+	changed chan struct{}
+}
+
+func newFakeHealthServer(t *testing.T, entries []*consulapi.ServiceEntry) (*fakeHealthServer, *httptest.Server) {
+	f := &fakeHealthServer{index: 1, entries: entries, changed: make(chan struct{})}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v1/health/service/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+		index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+
+		f.mu.Lock()
+		if index >= f.index {
+			changed := f.changed
+			f.mu.Unlock()
+			select {
+			case <-changed:
+			case <-time.After(wait):
+			}
+			f.mu.Lock()
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+		body, _ := json.Marshal(f.entries)
+		f.mu.Unlock()
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeHealthServer) set(entries []*consulapi.ServiceEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.index++
+	f.entries = entries
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func fakeServiceEntry(addr string, port int) *consulapi.ServiceEntry {
+	return &consulapi.ServiceEntry{
+		Service: &consulapi.AgentService{
+			Service: "svc.watch",
+			Address: addr,
+			Port:    port,
+			Weights: consulapi.AgentWeights{Passing: 10, Warning: 1},
+			Tags:    []string{"k1:v1"},
+		},
+	}
+}
+
+// TestWatchResolver tests that the watch resolver serves from the snapshot and notifies changes.
+func TestWatchResolver(t *testing.T) {
+	fake, srv := newFakeHealthServer(t, []*consulapi.ServiceEntry{fakeServiceEntry("10.0.0.1", 8080)})
+
+	changes := make(chan discovery.Change, 1)
+	r, err := NewConsulResolverWithConfig(&consulapi.Config{Address: strings.TrimPrefix(srv.URL, "http://")},
+		WithWatch(time.Second),
+		WithWatchNotify(func(change discovery.Change) { changes <- change }),
+	)
+	assert.Nil(t, err)
+	defer r.(io.Closer).Close()
+
+	result, err := r.Resolve(context.Background(), "svc.watch")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(result.Instances))
+	<-changes
+
+	fake.set([]*consulapi.ServiceEntry{fakeServiceEntry("10.0.0.1", 8080), fakeServiceEntry("10.0.0.2", 8080)})
+	select {
+	case change := <-changes:
+		if assert.Equal(t, 1, len(change.Added)) {
+			assert.Equal(t, "10.0.0.2:8080", change.Added[0].Address().String())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("change not notified")
+	}
+
+	result, err = r.Resolve(context.Background(), "svc.watch")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(result.Instances))
+
+	fake.set(nil)
+	<-changes
+	_, err = r.Resolve(context.Background(), "svc.watch")
+	assert.Equal(t, ErrNoServiceFound, err)
+}
+
+func TestWatchResolverClose(t *testing.T) {
+	_, srv := newFakeHealthServer(t, []*consulapi.ServiceEntry{fakeServiceEntry("10.0.0.1", 8080)})
+	r, err := NewConsulResolverWithConfig(&consulapi.Config{Address: strings.TrimPrefix(srv.URL, "http://")},
+		WithWatch(10*time.Second),
+		WithLastKnownGood(0),
+	)
+	assert.Nil(t, err)
+	_, err = r.Resolve(context.Background(), "svc.watch")
+	assert.Nil(t, err)
+
+	// the blocking query of the watcher is canceled
+	start := time.Now()
+	assert.Nil(t, r.(io.Closer).Close())
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 0, len(r.(*consulResolver).watchers))
+
+	// the last known good result is not served once the resolver is closed
+	_, err = r.Resolve(context.Background(), "svc.watch")
+	assert.Equal(t, ErrResolverClosed, err)
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second)
+		assert.True(t, d >= time.Second/2 && d < time.Second)
+	}
+	assert.Equal(t, time.Duration(0), jitter(0))
+}
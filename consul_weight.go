@@ -0,0 +1,101 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudwego/kitex/pkg/klog"
+	"github.com/cloudwego/kitex/pkg/registry"
+)
+
+// WeightProvider returns the weight the service of info should currently be registered with,
+// e.g. computed from its CPU usage or queue depth.
+type WeightProvider func(info *registry.Info) int
+
+// UpdateWeight changes the weight of the service of info registered by this registry, keeping its checks
+// and its TTL heartbeat. The warmup of the service, if any, is cancelled.
+func (c *consulRegistry) UpdateWeight(info *registry.Info, weight int) error {
+	if weight <= 0 {
+		return fmt.Errorf("invalid weight %d, it must be positive", weight)
+	}
+	svc, err := c.getRegisteredService(info)
+	if err != nil {
+		return err
+	}
+
+	svc.stopWarmup()
+	return c.reweight(context.Background(), svc, c.newWeights(weight))
+}
+
+// startWeightProvider start a goroutine to periodically poll the weight provider,
+// and update the weight of the service when it changes by more than the hysteresis.
+func (c *consulRegistry) startWeightProvider(svc *registeredService) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(c.opts.weightInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			// the warmup owns the weight until it is over, and the weight is kept during maintenance
+			if svc.isWarmingUp() {
+				continue
+			}
+			if inMaintenance, _ := svc.maintenanceState(); inMaintenance {
+				continue
+			}
+			weight := c.opts.weightProvider(svc.info)
+			if weight < 1 {
+				weight = 1
+			}
+			if !c.exceedsHysteresis(svc.passingWeight(c), weight) {
+				continue
+			}
+			if err := c.reweight(ctx, svc, c.newWeights(weight)); err != nil {
+				klog.Errorf("update weight of service %s to consul failed, err=%v", svc.id, err)
+			}
+		}
+	}()
+	return cancel
+}
+
+// exceedsHysteresis returns whether weight differs from the current weight by more than the hysteresis.
+func (c *consulRegistry) exceedsHysteresis(current, weight int) bool {
+	if weight == current {
+		return false
+	}
+	return math.Abs(float64(weight-current)) > float64(current)*c.opts.weightHysteresis
+}
+
+// passingWeight returns the passing weight the service is currently registered with.
+func (s *registeredService) passingWeight(c *consulRegistry) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return s.registration.Weights.Passing
+}
+
+func (s *registeredService) isWarmingUp() bool {
+	return atomic.LoadInt32(&s.warmingUp) == 1
+}
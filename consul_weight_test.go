@@ -0,0 +1,140 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/kitex/pkg/registry"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateWeight(t *testing.T) {
+	agent := newFakeAgent(t)
+	r := agent.newRegistry(t, WithCheck(&api.AgentServiceCheck{TTL: "5s"}))
+	info := newTestInfo(8080)
+
+	assert.NotNil(t, r.UpdateWeight(info, 50))
+
+	assert.Nil(t, r.Register(info))
+	assert.NotNil(t, r.UpdateWeight(info, 0))
+	assert.Nil(t, r.UpdateWeight(info, 50))
+	assert.Equal(t, []int{100, 50}, agent.registeredWeights())
+
+	// the check is registered again, and its status is reported right away
+	req, _ := agent.find("/v1/agent/service/register")
+	check, _ := req.Body["Check"].(map[string]interface{})
+	assert.Equal(t, "service:svc.fake:10.0.0.1:8080", check["CheckID"])
+	assert.Equal(t, "5s", check["TTL"])
+	_, ok := agent.find("/v1/agent/check/update/")
+	assert.True(t, ok)
+
+	assert.Nil(t, r.Deregister(info))
+}
+
+func TestWeightProvider(t *testing.T) {
+	var weight int32 = 100
+	provider := func(info *registry.Info) int {
+		return int(atomic.LoadInt32(&weight))
+	}
+	agent := newFakeAgent(t)
+	r := agent.newRegistry(t, WithWeightProvider(provider, 20*time.Millisecond, 0.1))
+	info := newTestInfo(8080)
+
+	assert.Nil(t, r.Register(info))
+	// changes within the hysteresis are ignored
+	atomic.StoreInt32(&weight, 95)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []int{100}, agent.registeredWeights())
+
+	atomic.StoreInt32(&weight, 50)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []int{100, 50}, agent.registeredWeights())
+
+	// the provider is stopped by Deregister
+	assert.Nil(t, r.Deregister(info))
+	atomic.StoreInt32(&weight, 10)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []int{100, 50}, agent.registeredWeights())
+}
+
+func TestWeightProviderWaitsForWarmup(t *testing.T) {
+	agent := newFakeAgent(t)
+	r := agent.newRegistry(t,
+		WithWarmup(200*time.Millisecond, WarmupLinear),
+		WithWeightProvider(func(info *registry.Info) int { return 30 }, 20*time.Millisecond, 0),
+	)
+	info := newTestInfo(8080)
+
+	assert.Nil(t, r.Register(info))
+	time.Sleep(400 * time.Millisecond)
+	weights := agent.registeredWeights()
+	assert.Equal(t, []int{1, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100, 30}, weights)
+	assert.Nil(t, r.Deregister(info))
+}
+
+func TestUpdateWeightDoesNotBlockRegister(t *testing.T) {
+	agent := newFakeAgent(t)
+	var slow int32
+	r := agent.newRegistry(t,
+		WithCheck(&api.AgentServiceCheck{TTL: "5s"}),
+		WithHealthProbeTimeout(time.Second, api.HealthCritical),
+		WithHealthProbe(func(ctx context.Context) (string, string) {
+			if atomic.LoadInt32(&slow) == 1 {
+				time.Sleep(500 * time.Millisecond)
+			}
+			return api.HealthPassing, ""
+		}),
+	)
+	info := newTestInfo(8080)
+	assert.Nil(t, r.Register(info))
+
+	atomic.StoreInt32(&slow, 1)
+	done := make(chan error, 1)
+	go func() { done <- r.UpdateWeight(info, 50) }()
+	time.Sleep(100 * time.Millisecond)
+
+	// the slow health probe of the TTL check does not hold the registry
+	start := time.Now()
+	assert.Nil(t, r.Register(newTestInfo(8081)))
+	assert.True(t, time.Since(start) < 300*time.Millisecond)
+	assert.Nil(t, <-done)
+}
+
+func TestUpdateWeightKeepsMaintenance(t *testing.T) {
+	agent := newFakeAgent(t)
+	r := agent.newRegistry(t)
+	info := newTestInfo(8080)
+
+	assert.Nil(t, r.Register(info))
+	assert.Nil(t, r.EnableMaintenance(info, "upgrade"))
+	assert.Nil(t, r.UpdateWeight(info, 50))
+
+	// the re-registration clears the maintenance mode in consul, it is enabled again
+	assert.Equal(t, 2, agent.countRequests("/v1/agent/service/maintenance/svc.fake:10.0.0.1:8080"))
+	req, _ := agent.find("/v1/agent/service/maintenance/")
+	assert.Contains(t, req.Query, "enable=true")
+	assert.Contains(t, req.Query, "reason=upgrade")
+	inMaintenance, err := r.InMaintenance(info)
+	assert.Nil(t, err)
+	assert.True(t, inMaintenance)
+	assert.Nil(t, r.Deregister(info))
+}
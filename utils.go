@@ -20,54 +20,261 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
 
-	"github.com/cloudwego/kitex/pkg/registry"
+	"github.com/cloudwego/kitex/pkg/klog"
+	"github.com/hashicorp/consul/api"
 )
 
+// IPPreference is which IP family is used for the addresses of services.
+type IPPreference int
+
+const (
+	// PreferIPv4 uses IPv4 addresses, and IPv6 addresses if there is no IPv4 address.
+	PreferIPv4 IPPreference = iota
+	// PreferIPv6 uses IPv6 addresses, and IPv4 addresses if there is no IPv6 address.
+	PreferIPv6
+	// DualStack uses the addresses of both families, the IPv4 one being the primary address.
+	DualStack
+)
+
+// consul tagged addresses of the services.
+const (
+	taggedLANIPv4 = "lan_ipv4"
+	taggedLANIPv6 = "lan_ipv6"
+)
+
+// serviceAddr is the address a service is registered with.
+type serviceAddr struct {
+	// network is empty for TCP, or the Unix domain socket network whose socket path is host.
+	network string
+	host    string
+	port    int
+	source  AddressSource
+	// ipv4 and ipv6 are registered as the tagged addresses of the service, if not empty.
+	ipv4 string
+	ipv6 string
+	// tagged are the tagged addresses set by the options, overriding the ones of ipv4 and ipv6.
+	tagged map[string]api.ServiceAddress
+}
+
+// taggedAddresses returns the consul tagged addresses of the service.
+func (a serviceAddr) taggedAddresses() map[string]api.ServiceAddress {
+	tagged := make(map[string]api.ServiceAddress, 2)
+	if a.ipv4 != "" {
+		tagged[taggedLANIPv4] = api.ServiceAddress{Address: a.ipv4, Port: a.port}
+	}
+	if a.ipv6 != "" {
+		tagged[taggedLANIPv6] = api.ServiceAddress{Address: a.ipv6, Port: a.port}
+	}
+	for k, v := range a.tagged {
+		if v.Port == 0 {
+			v.Port = a.port
+		}
+		tagged[k] = v
+	}
+	if len(tagged) == 0 {
+		return nil
+	}
+	return tagged
+}
+
+// addressOptions decides the address a service is registered with.
+type addressOptions struct {
+	ipPreference     IPPreference
+	advertiseHost    string
+	advertisePort    int
+	advertiseHostEnv string
+	interfaces       []string
+	allowCIDRs       []string
+	denyCIDRs        []string
+	agentAddress     bool
+	taggedAddresses  map[string]api.ServiceAddress
+}
+
+// addrFilter selects the local addresses which can be advertised.
+type addrFilter struct {
+	interfaces []string
+	allow      []*net.IPNet
+	deny       []*net.IPNet
+}
+
+func newAddrFilter(opts addressOptions) (addrFilter, error) {
+	f := addrFilter{interfaces: opts.interfaces}
+	var err error
+	if f.allow, err = parseCIDRs(opts.allowCIDRs); err != nil {
+		return addrFilter{}, err
+	}
+	if f.deny, err = parseCIDRs(opts.denyCIDRs); err != nil {
+		return addrFilter{}, err
+	}
+	return f, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// interfaceAddrs returns the addresses of the selected interfaces, or of all the interfaces if none is selected.
+func (f addrFilter) interfaceAddrs() ([]net.Addr, error) {
+	if len(f.interfaces) == 0 {
+		return net.InterfaceAddrs()
+	}
+	var addrs []net.Addr
+	for _, name := range f.interfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("get interface %s error, cause %w", name, err)
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, ifaceAddrs...)
+	}
+	return addrs, nil
+}
+
+// match returns whether ip is in none of the denied networks, and in one of the allowed networks if any.
+func (f addrFilter) match(ip net.IP) bool {
+	for _, ipNet := range f.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, ipNet := range f.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func getLocalIPv4Address() (string, error) {
-	addr, err := net.InterfaceAddrs()
+	return getLocalIPAddress(false, addrFilter{})
+}
+
+// getLocalIPAddress returns the first non-loopback IPv4 address, or the first global unicast IPv6 address if v6,
+// among the addresses selected by f.
+func getLocalIPAddress(v6 bool, f addrFilter) (string, error) {
+	addr, err := f.interfaceAddrs()
 	if err != nil {
 		return "", err
 	}
 
 	for _, addr := range addr {
 		ipNet, isIpNet := addr.(*net.IPNet)
-		if isIpNet && !ipNet.IP.IsLoopback() {
-			ipv4 := ipNet.IP.To4()
-			if ipv4 != nil {
+		if !isIpNet || ipNet.IP.IsLoopback() || !f.match(ipNet.IP) {
+			continue
+		}
+		if ipv4 := ipNet.IP.To4(); ipv4 != nil {
+			if !v6 {
 				return ipv4.String(), nil
 			}
+		} else if v6 && ipNet.IP.IsGlobalUnicast() {
+			return ipNet.IP.String(), nil
 		}
 	}
+	if v6 {
+		return "", errors.New("not found ipv6 address")
+	}
 	return "", errors.New("not found ipv4 address")
 }
 
-func parseAddr(addr net.Addr) (host string, port int, err error) {
-	host, portStr, err := net.SplitHostPort(addr.String())
-	if err != nil {
-		return "", 0, err
+// getLocalAddress returns the local addresses selected by f of the families used by pref.
+func getLocalAddress(pref IPPreference, f addrFilter) (ipv4, ipv6 string, err error) {
+	ipv4, err4 := getLocalIPAddress(false, f)
+	if err4 == nil && pref == PreferIPv4 {
+		return ipv4, "", nil
 	}
-	if host == "" || host == "::" {
-		host, err = getLocalIPv4Address()
-		if err != nil {
-			return "", 0, fmt.Errorf("get local ipv4 error, cause %w", err)
+	ipv6, err6 := getLocalIPAddress(true, f)
+	switch {
+	case err4 != nil && err6 != nil:
+		return "", "", fmt.Errorf("%v, %w", err4, err6)
+	case pref == PreferIPv6 && err6 == nil:
+		return "", ipv6, nil
+	case pref == DualStack:
+		return ipv4, ipv6, nil
+	case err4 == nil:
+		return ipv4, "", nil
+	default:
+		return "", ipv6, nil
+	}
+}
+
+// parseAddr returns the address a service listening on addr is registered with.
+// The advertised host is, in order, the explicit one, the one of the environment variable, the listened one
+// unless it is unspecified, the one returned by agentHost if not nil, and the local addresses of the selected
+// interfaces. Unix domain socket addresses are registered with their socket path as host and no port.
+func parseAddr(addr net.Addr, opts addressOptions, agentHost func() (string, error)) (serviceAddr, error) {
+	if network := addr.Network(); isUnixNetwork(network) {
+		// the socket path is only reachable on the same host, the address options do not apply
+		if addr.String() == "" {
+			return serviceAddr{}, errors.New("missing socket path of unix address")
 		}
+		return serviceAddr{network: network, host: addr.String(), source: AddressListened}, nil
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return serviceAddr{}, err
 	}
-	port, err = net.LookupPort(defaultNetwork, portStr)
+	port, err := net.LookupPort(defaultNetwork, portStr)
 	if err != nil {
-		return "", 0, err
+		return serviceAddr{}, err
+	}
+	if opts.advertisePort > 0 {
+		port = opts.advertisePort
 	}
 	if port == 0 {
-		return "", 0, fmt.Errorf("invalid port %s", portStr)
+		return serviceAddr{}, fmt.Errorf("invalid port %s", portStr)
 	}
 
-	return host, port, nil
-}
+	source := AddressListened
+	if opts.advertiseHost != "" {
+		host, source = opts.advertiseHost, AddressAdvertised
+	} else if v := os.Getenv(opts.advertiseHostEnv); v != "" {
+		host, source = v, AddressEnv
+	}
+	if ip := net.ParseIP(host); (host == "" || ip.IsUnspecified()) && agentHost != nil {
+		if v, err := agentHost(); err == nil {
+			host, source = v, AddressAgent
+		} else {
+			klog.Warnf("get address of consul agent failed, fall back to network interfaces, err=%v", err)
+		}
+	}
 
-func getServiceId(info *registry.Info) (string, error) {
-	host, port, err := parseAddr(info.Addr)
-	if err != nil {
-		return "", err
+	sa := serviceAddr{host: host, port: port, source: source, tagged: opts.taggedAddresses}
+	ip := net.ParseIP(host)
+	switch {
+	case host == "" || ip.IsUnspecified():
+		f, err := newAddrFilter(opts)
+		if err != nil {
+			return serviceAddr{}, err
+		}
+		sa.ipv4, sa.ipv6, err = getLocalAddress(opts.ipPreference, f)
+		if err != nil {
+			return serviceAddr{}, fmt.Errorf("get local ip error, cause %w", err)
+		}
+		sa.host = sa.ipv4
+		if sa.host == "" {
+			sa.host = sa.ipv6
+		}
+		sa.source = AddressInterface
+	case ip.To4() != nil:
+		sa.ipv4 = host
+	case ip != nil:
+		sa.ipv6 = host
 	}
-	return fmt.Sprintf("%s:%s:%d", info.ServiceName, host, port), nil
+	return sa, nil
 }
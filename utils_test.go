@@ -0,0 +1,167 @@
+/*
+ * Copyright 2021 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func getLocalIPv6Address() (string, error) {
+	return getLocalIPAddress(true, addrFilter{})
+}
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		name       string
+		addr       net.Addr
+		want       serviceAddr
+		wantTagged map[string]api.ServiceAddress
+		wantErr    bool
+	}{
+		{
+			name:       "IPv4",
+			addr:       &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8080},
+			want:       serviceAddr{host: "10.0.0.1", port: 8080, ipv4: "10.0.0.1"},
+			wantTagged: map[string]api.ServiceAddress{taggedLANIPv4: {Address: "10.0.0.1", Port: 8080}},
+		},
+		{
+			name:       "IPv6",
+			addr:       &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 8080},
+			want:       serviceAddr{host: "fd00::1", port: 8080, ipv6: "fd00::1"},
+			wantTagged: map[string]api.ServiceAddress{taggedLANIPv6: {Address: "fd00::1", Port: 8080}},
+		},
+		{
+			name:    "Invalid port",
+			addr:    &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAddr(tt.addr, addressOptions{}, nil)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantTagged, got.taggedAddresses())
+		})
+	}
+}
+
+func TestParseUnspecifiedAddr(t *testing.T) {
+	ipv4, err4 := getLocalIPv4Address()
+	ipv6, err6 := getLocalIPv6Address()
+	if err4 != nil && err6 != nil {
+		t.Skip("no local address")
+	}
+
+	got, err := parseAddr(&net.TCPAddr{IP: net.IPv6unspecified, Port: 8080}, addressOptions{ipPreference: DualStack}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, ipv4, got.ipv4)
+	assert.Equal(t, ipv6, got.ipv6)
+	if err4 == nil {
+		assert.Equal(t, ipv4, got.host)
+	} else {
+		assert.Equal(t, ipv6, got.host)
+	}
+
+	got, err = parseAddr(&net.TCPAddr{Port: 8080}, addressOptions{ipPreference: PreferIPv6}, nil)
+	assert.Nil(t, err)
+	if err6 == nil {
+		assert.Equal(t, serviceAddr{host: ipv6, port: 8080, source: AddressInterface, ipv6: ipv6}, got)
+	} else {
+		assert.Equal(t, serviceAddr{host: ipv4, port: 8080, source: AddressInterface, ipv4: ipv4}, got)
+	}
+}
+
+func TestParseAdvertisedAddr(t *testing.T) {
+	t.Setenv("TEST_POD_IP", "fd00::3")
+	listen := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8080}
+	tests := []struct {
+		name string
+		opts addressOptions
+		want serviceAddr
+	}{
+		{
+			name: "Advertised host and port",
+			opts: addressOptions{advertiseHost: "203.0.113.1", advertisePort: 30080},
+			want: serviceAddr{host: "203.0.113.1", port: 30080, source: AddressAdvertised, ipv4: "203.0.113.1"},
+		},
+		{
+			name: "Advertised port",
+			opts: addressOptions{advertisePort: 30080},
+			want: serviceAddr{host: "10.0.0.1", port: 30080, ipv4: "10.0.0.1"},
+		},
+		{
+			name: "Advertised host name",
+			opts: addressOptions{advertiseHost: "svc.example.com"},
+			want: serviceAddr{host: "svc.example.com", port: 8080, source: AddressAdvertised},
+		},
+		{
+			name: "Environment variable",
+			opts: addressOptions{advertiseHostEnv: "TEST_POD_IP"},
+			want: serviceAddr{host: "fd00::3", port: 8080, source: AddressEnv, ipv6: "fd00::3"},
+		},
+		{
+			name: "Unset environment variable",
+			opts: addressOptions{advertiseHostEnv: "TEST_UNSET_POD_IP"},
+			want: serviceAddr{host: "10.0.0.1", port: 8080, ipv4: "10.0.0.1"},
+		},
+		{
+			name: "Advertised host over environment variable",
+			opts: addressOptions{advertiseHost: "10.0.0.2", advertiseHostEnv: "TEST_POD_IP"},
+			want: serviceAddr{host: "10.0.0.2", port: 8080, source: AddressAdvertised, ipv4: "10.0.0.2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAddr(listen, tt.opts, nil)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAddrFilter(t *testing.T) {
+	_, err := newAddrFilter(addressOptions{allowCIDRs: []string{"10.0.0.0"}})
+	assert.NotNil(t, err)
+	_, err = parseAddr(&net.TCPAddr{Port: 8080}, addressOptions{denyCIDRs: []string{"invalid"}}, nil)
+	assert.NotNil(t, err)
+	_, err = parseAddr(&net.TCPAddr{Port: 8080}, addressOptions{interfaces: []string{"no-such-interface"}}, nil)
+	assert.NotNil(t, err)
+
+	f, err := newAddrFilter(addressOptions{
+		allowCIDRs: []string{"10.0.0.0/8", "fd00::/8"},
+		denyCIDRs:  []string{"10.1.0.0/16"},
+	})
+	assert.Nil(t, err)
+	assert.True(t, f.match(net.ParseIP("10.0.0.1")))
+	assert.True(t, f.match(net.ParseIP("fd00::1")))
+	assert.False(t, f.match(net.ParseIP("10.1.0.1")))
+	assert.False(t, f.match(net.ParseIP("172.17.0.1")))
+
+	f, err = newAddrFilter(addressOptions{denyCIDRs: []string{"172.17.0.0/16"}})
+	assert.Nil(t, err)
+	assert.True(t, f.match(net.ParseIP("10.0.0.1")))
+	assert.False(t, f.match(net.ParseIP("172.17.0.1")))
+}